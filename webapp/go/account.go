@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+	"net/http"
+)
+
+const saltChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// newSalt fills the salts table for new users. It is only used by the
+// sha512 scheme, but the column is kept for every user.
+func newSalt() (string, error) {
+	b := make([]byte, 6)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(saltChars))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = saltChars[n.Int64()]
+	}
+	return string(b), nil
+}
+
+func GetSignup(w http.ResponseWriter, r *http.Request) error {
+	return renderSignup(w, r, http.StatusOK, User{}, nil)
+}
+
+func renderSignup(w http.ResponseWriter, r *http.Request, status int, form User, errs fieldErrors) error {
+	token, err := csrfToken(w, r)
+	if err != nil {
+		return err
+	}
+	return render(w, status, "signup.html", struct {
+		Form      User
+		Errors    fieldErrors
+		CSRFToken string
+	}{form, errs, token})
+}
+
+func PostSignup(w http.ResponseWriter, r *http.Request) error {
+	user := User{
+		AccountName: r.FormValue("account_name"),
+		NickName:    r.FormValue("nick_name"),
+		Email:       r.FormValue("email"),
+	}
+	errs := signupRules.validate(r)
+	if _, ok := users.ByAccountName(user.AccountName); ok {
+		errs["account_name"] = "既に使われています"
+	}
+	if _, ok := users.ByEmail(user.Email); ok {
+		errs["email"] = "既に登録されています"
+	}
+	if len(errs) > 0 {
+		return renderSignup(w, r, http.StatusBadRequest, user, errs)
+	}
+
+	hash, err := currentHasher.Hash(r.FormValue("password"))
+	if err != nil {
+		return err
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+	user.PassHash = hash
+	id, err := storage.CreateUser(user, salt)
+	if err != nil {
+		return err
+	}
+	user.ID = id
+	users.Add(user, salt)
+
+	if err := startSession(w, r, user.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+func GetAccount(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	return renderAccount(w, r, http.StatusOK, nil)
+}
+
+// renderAccount shows the forms to change the email, password and nick
+// name. The fields of the three forms have distinct names, so one errs
+// serves all of them.
+func renderAccount(w http.ResponseWriter, r *http.Request, status int, errs fieldErrors) error {
+	token, err := csrfToken(w, r)
+	if err != nil {
+		return err
+	}
+	_, revocable := store.(*serverStore)
+	return render(w, status, "account.html", struct {
+		User      *User
+		Errors    fieldErrors
+		CSRFToken string
+		Revocable bool
+	}{getCurrentUser(w, r), errs, token, revocable})
+}
+
+func PostAccountEmail(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := *getCurrentUser(w, r)
+	email := r.FormValue("email")
+
+	errs := emailChangeRules.validate(r)
+	if other, ok := users.ByEmail(email); ok && other.ID != user.ID {
+		errs["email"] = "既に登録されています"
+	}
+	if _, ok := errs["email_password"]; !ok && !checkPassword(user, r.FormValue("email_password")) {
+		errs["email_password"] = "パスワードが違います"
+	}
+	if len(errs) > 0 {
+		return renderAccount(w, r, http.StatusBadRequest, errs)
+	}
+
+	// Each form stores only its own field and refreshes it in the
+	// directory, so the change is visible without /initialize.
+	if err := storage.UpdateEmail(user.ID, email); err != nil {
+		return err
+	}
+	users.Update(user.ID, func(u *User) { u.Email = email })
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+	return nil
+}
+
+func PostAccountPassword(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := *getCurrentUser(w, r)
+
+	errs := passwordChangeRules.validate(r)
+	if _, ok := errs["current_password"]; !ok && !checkPassword(user, r.FormValue("current_password")) {
+		errs["current_password"] = "パスワードが違います"
+	}
+	if len(errs) > 0 {
+		return renderAccount(w, r, http.StatusBadRequest, errs)
+	}
+
+	hash, err := currentHasher.Hash(r.FormValue("new_password"))
+	if err != nil {
+		return err
+	}
+	if err := storage.UpdatePassHash(user.ID, hash); err != nil {
+		return err
+	}
+	users.Update(user.ID, func(u *User) { u.PassHash = hash })
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+	return nil
+}
+
+func PostAccountNickName(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := *getCurrentUser(w, r)
+
+	if errs := nickNameChangeRules.validate(r); len(errs) > 0 {
+		return renderAccount(w, r, http.StatusBadRequest, errs)
+	}
+
+	nickName := r.FormValue("nick_name")
+	if err := storage.UpdateNickName(user.ID, nickName); err != nil {
+		return err
+	}
+	users.Update(user.ID, func(u *User) { u.NickName = nickName })
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+	return nil
+}
+
+// PostAccountLogoutAll ends every session of the user, including the
+// current one. Cookie sessions can't be revoked, so it needs serverStore.
+func PostAccountLogoutAll(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	st, ok := store.(*serverStore)
+	if !ok {
+		return ErrBadRequest
+	}
+	user := getCurrentUser(w, r)
+	if err := st.backend.DeleteUser(user.ID); err != nil {
+		return err
+	}
+	return GetLogout(w, r)
+}
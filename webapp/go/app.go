@@ -1,24 +1,18 @@
 package main
 
 import (
-	"crypto/sha512"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"html/template"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"path"
 	"runtime"
-	"sort"
+	"runtime/debug"
 	"strconv"
-	"strings"
 	"time"
 
-	redis "github.com/garyburd/redigo/redis"
 	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
@@ -26,11 +20,10 @@ import (
 )
 
 var (
-	redisConn redis.Conn
-	db        *sql.DB
-	store     *sessions.CookieStore
-	users     map[int]User
-	salts     map[int]string
+	db      *sql.DB
+	storage Store
+	store   sessions.Store
+	users   = newUserDirectory()
 )
 
 type User struct {
@@ -58,6 +51,15 @@ type Entry struct {
 	Title     string
 	Content   string
 	CreatedAt time.Time
+	UpdatedAt mysql.NullTime
+}
+
+// LastUpdated is when the entry was last edited, or written if it never was.
+func (e Entry) LastUpdated() time.Time {
+	if e.UpdatedAt.Valid {
+		return e.UpdatedAt.Time
+	}
+	return e.CreatedAt
 }
 
 type Comment struct {
@@ -68,6 +70,12 @@ type Comment struct {
 	CreatedAt time.Time
 }
 
+type Relation struct {
+	One       int
+	Another   int
+	CreatedAt time.Time
+}
+
 type Friend struct {
 	ID        int
 	CreatedAt time.Time
@@ -83,8 +91,12 @@ type Footprint struct {
 type FootprintGroup struct {
 	UserID  int
 	OwnerID int
+	Day     string
 }
 
+// sexes are the options of the sex select in profile.html.
+var sexes = []string{"未指定", "男性", "女性", "その他"}
+
 var prefs = []string{"未入力",
 	"北海道", "青森県", "岩手県", "宮城県", "秋田県", "山形県", "福島県", "茨城県", "栃木県", "群馬県", "埼玉県", "千葉県", "東京都", "神奈川県", "新潟県", "富山県",
 	"石川県", "福井県", "山梨県", "長野県", "岐阜県", "静岡県", "愛知県", "三重県", "滋賀県", "京都府", "大阪府", "兵庫県", "奈良県", "和歌山県", "鳥取県", "島根県",
@@ -94,102 +106,35 @@ var (
 	ErrAuthentication   = errors.New("Authentication error.")
 	ErrPermissionDenied = errors.New("Permission denied.")
 	ErrContentNotFound  = errors.New("Content not found.")
+	ErrBadRequest       = errors.New("Bad request.")
+	ErrConflict         = errors.New("Conflict.")
+	ErrInvalidCSRFToken = errors.New("Invalid CSRF token.")
 )
 
-// ===== Redis Seed Start =====
-func InitializeFootprints() {
-	var isNotRequired map[FootprintGroup]bool = map[FootprintGroup]bool{}
-	var maxCreatedAt map[FootprintGroup]time.Time = map[FootprintGroup]time.Time{}
-	var fps []Footprint
-
-	rows, err := db.Query(`SELECT user_id, owner_id, created_at FROM footprints`)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		fp := Footprint{}
-		checkErr(rows.Scan(&fp.UserID, &fp.OwnerID, &fp.CreatedAt))
-
-		group := FootprintGroup{
-			UserID:  fp.UserID,
-			OwnerID: fp.OwnerID,
-		}
-
-		if fp.CreatedAt.UnixNano() > maxCreatedAt[group].UnixNano() {
-			maxCreatedAt[group] = fp.CreatedAt
-		}
-
-		fps = append(fps, fp)
+func authenticate(w http.ResponseWriter, r *http.Request, email, passwd string) error {
+	user, ok := users.ByEmail(email)
+	if !ok {
+		return ErrAuthentication
 	}
 
-	for _, fp := range fps {
-		group := FootprintGroup{
-			UserID:  fp.UserID,
-			OwnerID: fp.OwnerID,
-		}
-
-		if isNotRequired[group] {
-			continue
-		}
-		isNotRequired[group] = true
-
-		var tmpFp Footprint
-		tmpFp = Footprint{
-			UserID:    fp.UserID,
-			OwnerID:   fp.OwnerID,
-			CreatedAt: maxCreatedAt[group],
-			UpdatedAt: maxCreatedAt[group],
-		}
-
-		tmpFpJson, err := json.Marshal(tmpFp)
-		if err != nil {
-			log.Fatalf("Can not marshal footprint to json.: %s\n", err.Error())
-		}
-		redisConn.Do("ZADD", fmt.Sprintf("footprints:user_id:%d", tmpFp.UserID), -tmpFp.CreatedAt.UnixNano(), tmpFpJson)
+	if !checkPassword(user, passwd) {
+		return ErrAuthentication
 	}
-}
 
-func FetchFootprints(userId int, limit int) (footprints []Footprint) {
-	fps, err := redis.Values(redisConn.Do("ZRANGE", fmt.Sprintf("footprints:user_id:%d", userId), 0, limit-1))
-	if err != nil {
-		log.Fatalf("Can not fetch data from cache: %s.", err.Error())
-	}
-
-	for _, fpJson := range fps {
-		fp := Footprint{}
-		json.Unmarshal(fpJson.([]byte), &fp)
-		footprints = append(footprints, fp)
-	}
-
-	return
+	return startSession(w, r, user.ID)
 }
 
-// ===== Redis Seed End =====
-
-func authenticate(w http.ResponseWriter, r *http.Request, email, passwd string) {
-	var user User
-	for _, user = range users {
-		if user.Email == email {
-			break
+func startSession(w http.ResponseWriter, r *http.Request, userID int) error {
+	session := getSession(w, r)
+	if st, ok := store.(*serverStore); ok {
+		if err := st.Renew(session); err != nil {
+			return err
 		}
 	}
-
-	if user.Email == "" {
-		checkErr(ErrAuthentication)
-	}
-
-	salt, _ := salts[user.ID]
-	hash := fmt.Sprintf("%x", sha512.Sum512([]byte(fmt.Sprintf("%s%s", passwd, salt))))
-
-	if hash != user.PassHash {
-		checkErr(ErrAuthentication)
-	}
-
-	session := getSession(w, r)
-	session.Values["user_id"] = user.ID
-	session.Save(r, w)
+	session.Values["user_id"] = userID
+	// A new login gets a new token, so one seen before login is useless.
+	delete(session.Values, csrfSessionKey)
+	return session.Save(r, w)
 }
 
 func getCurrentUser(w http.ResponseWriter, r *http.Request) *User {
@@ -204,7 +149,11 @@ func getCurrentUser(w http.ResponseWriter, r *http.Request) *User {
 		return nil
 	}
 
-	user, _ := users[userID.(int)]
+	user, err := lookupUser(userID.(int))
+	if err != nil {
+		log.Printf("Failed to get the user of the session (userID:%d): %s", userID, err.Error())
+		return nil
+	}
 	context.Set(r, "user", user)
 	return &user
 }
@@ -218,45 +167,25 @@ func authenticated(w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
-func getUser(w http.ResponseWriter, userID int) *User {
-	user, ok := users[userID]
-	if ok != true {
-		log.Fatalf("Cannot get user object from memory (userID:%d\n)", userID)
+func getUser(w http.ResponseWriter, userID int) (*User, error) {
+	user, err := lookupUser(userID)
+	if err != nil {
+		return nil, err
 	}
-	return &user
+	return &user, nil
 }
 
-func getUserFromAccount(w http.ResponseWriter, name string) *User {
-	for _, user := range users {
-		if user.AccountName == name {
-			return &user
-		}
+func getUserFromAccount(w http.ResponseWriter, name string) (*User, error) {
+	user, ok := users.ByAccountName(name)
+	if !ok {
+		return nil, ErrContentNotFound
 	}
-	user := User{}
-	return &user
-}
-
-func checkFriendFromSlice(friends []int, id int) bool {
-	index := sort.SearchInts(friends, id)
-	return index < len(friends) && friends[index] == id
+	return &user, nil
 }
 
 func isFriend(w http.ResponseWriter, r *http.Request, anotherID int) bool {
-	session := getSession(w, r)
-	id := session.Values["user_id"]
-	row := db.QueryRow(`SELECT COUNT(1) AS cnt FROM relations WHERE (one = ? AND another = ?)`, id, anotherID)
-	cnt := new(int)
-	err := row.Scan(cnt)
-	checkErr(err)
-	return *cnt > 0
-}
-
-func isFriendAccount(w http.ResponseWriter, r *http.Request, name string) bool {
-	user := getUserFromAccount(w, name)
-	if user == nil {
-		return false
-	}
-	return isFriend(w, r, user.ID)
+	user := getCurrentUser(w, r)
+	return friendships.IsFriend(user.ID, anotherID)
 }
 
 func permitted(w http.ResponseWriter, r *http.Request, anotherID int) bool {
@@ -267,46 +196,80 @@ func permitted(w http.ResponseWriter, r *http.Request, anotherID int) bool {
 	return isFriend(w, r, anotherID)
 }
 
-func markFootprint(w http.ResponseWriter, r *http.Request, id int) {
+func markFootprint(w http.ResponseWriter, r *http.Request, id int) error {
 	user := getCurrentUser(w, r)
 	if user.ID != id {
-		_, err := db.Exec(`INSERT INTO footprints (user_id,owner_id) VALUES (?,?)`, id, user.ID)
-		checkErr(err)
+		// Both stores get the same time, so they agree on the day.
+		t := now()
+		if err := storage.AddFootprint(id, user.ID, t); err != nil {
+			return err
+		}
+		pruneFootprintsOnWrite(id)
+		cacheFootprint(id, user.ID, t)
+	}
+	return nil
+}
+
+// isDuplicateEntry reports whether err is a MySQL unique key violation.
+func isDuplicateEntry(err error) bool {
+	me, ok := err.(*mysql.MySQLError)
+	return ok && me.Number == 1062
+}
+
+// writeError turns an error returned by a handler into a response.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var rerr error
+	locked, isLocked := err.(*loginLockedError)
+	switch {
+	case err == ErrAuthentication || isLocked:
+		session := getSession(w, r)
+		delete(session.Values, "user_id")
+		session.Save(r, w)
+		if isLocked {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(locked.until).Seconds())+1))
+			rerr = render(w, http.StatusTooManyRequests, "login_locked.html", struct{ Message string }{"ログインの試行回数が多すぎます。しばらくしてから再度お試しください"})
+		} else {
+			rerr = renderLogin(w, r, http.StatusUnauthorized, "ログインに失敗しました")
+		}
+	case err == ErrInvalidCSRFToken:
+		rerr = render(w, http.StatusForbidden, "error.html", struct{ Message string }{"ページの有効期限が切れました。もう一度やり直してください"})
+	case err == ErrPermissionDenied:
+		rerr = render(w, http.StatusForbidden, "error.html", struct{ Message string }{"友人のみしかアクセスできません"})
+	case err == ErrContentNotFound:
+		rerr = render(w, http.StatusNotFound, "error.html", struct{ Message string }{"要求されたコンテンツは存在しません"})
+	case err == ErrBadRequest:
+		rerr = render(w, http.StatusBadRequest, "error.html", struct{ Message string }{"リクエストが正しくありません"})
+	case err == ErrConflict || isDuplicateEntry(err):
+		rerr = render(w, http.StatusConflict, "error.html", struct{ Message string }{"既に登録されています"})
+	default:
+		// The error may carry MySQL or Redis details, so it is only logged.
+		log.Printf("%s %s: %s", r.Method, r.URL.Path, err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+	if rerr != nil {
+		// render writes nothing when it fails.
+		log.Printf("Failed to render the error page for %s: %s", err.Error(), rerr.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// recoverPanic is the last resort for a handler that panicked. It logs the
+// stack trace and answers with a plain 500, which cannot panic again.
+func recoverPanic(w http.ResponseWriter, r *http.Request) {
+	rcv := recover()
+	if rcv == nil {
+		return
 	}
+	log.Printf("panic: %s %s: %v\n%s", r.Method, r.URL.Path, rcv, debug.Stack())
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
-func myHandler(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+func myHandler(fn func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			rcv := recover()
-			if rcv != nil {
-				switch {
-				case rcv == ErrAuthentication:
-					session := getSession(w, r)
-					delete(session.Values, "user_id")
-					session.Save(r, w)
-					render(w, r, http.StatusUnauthorized, "login.html", struct{ Message string }{"ログインに失敗しました"})
-					return
-				case rcv == ErrPermissionDenied:
-					render(w, r, http.StatusForbidden, "error.html", struct{ Message string }{"友人のみしかアクセスできません"})
-					return
-				case rcv == ErrContentNotFound:
-					render(w, r, http.StatusNotFound, "error.html", struct{ Message string }{"要求されたコンテンツは存在しません"})
-					return
-				default:
-					var msg string
-					if e, ok := rcv.(runtime.Error); ok {
-						msg = e.Error()
-					}
-					if s, ok := rcv.(string); ok {
-						msg = s
-					}
-					msg = rcv.(error).Error()
-					http.Error(w, msg, http.StatusInternalServerError)
-				}
-			}
-		}()
-		fn(w, r)
+		defer recoverPanic(w, r)
+		if err := fn(w, r); err != nil {
+			writeError(w, r, err)
+		}
 	}
 }
 
@@ -315,528 +278,510 @@ func getSession(w http.ResponseWriter, r *http.Request) *sessions.Session {
 	return session
 }
 
-func getTemplatePath(file string) string {
-	return path.Join("templates", file)
-}
-
-func render(w http.ResponseWriter, r *http.Request, status int, file string, data interface{}) {
-	fmap := template.FuncMap{
-		"getUser": func(id int) *User {
-			return getUser(w, id)
-		},
-		"getCurrentUser": func() *User {
-			return getCurrentUser(w, r)
-		},
-		"isFriend": func(id int) bool {
-			return isFriend(w, r, id)
-		},
-		"prefectures": func() []string {
-			return prefs
-		},
-		"substring": func(s string, l int) string {
-			if len(s) > l {
-				return s[:l]
-			}
-			return s
-		},
-		"split": strings.Split,
-		"getEntry": func(id int) Entry {
-			row := db.QueryRow(`SELECT * FROM entries WHERE id=?`, id)
-			var entryID, userID, private int
-			var body string
-			var createdAt time.Time
-			var title string
-			checkErr(row.Scan(&entryID, &userID, &private, &body, &createdAt, &title))
-			return Entry{id, userID, private == 1, title, body, createdAt}
-		},
-		"numComments": func(id int) int {
-			row := db.QueryRow(`SELECT COUNT(*) AS c FROM comments WHERE entry_id = ?`, id)
-			var n int
-			checkErr(row.Scan(&n))
-			return n
-		},
-	}
-	tpl := template.Must(template.New(file).Funcs(fmap).ParseFiles(getTemplatePath(file), getTemplatePath("header.html")))
-	w.WriteHeader(status)
-	checkErr(tpl.Execute(w, data))
-}
-
-func GetLogin(w http.ResponseWriter, r *http.Request) {
-	render(w, r, http.StatusOK, "login.html", struct{ Message string }{"高負荷に耐えられるSNSコミュニティサイトへようこそ!"})
-}
-
-func PostLogin(w http.ResponseWriter, r *http.Request) {
+func GetLogin(w http.ResponseWriter, r *http.Request) error {
+	return renderLogin(w, r, http.StatusOK, "高負荷に耐えられるSNSコミュニティサイトへようこそ!")
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, status int, message string) error {
+	token, err := csrfToken(w, r)
+	if err != nil {
+		return err
+	}
+	return render(w, status, "login.html", struct {
+		Message   string
+		CSRFToken string
+	}{message, token})
+}
+
+func PostLogin(w http.ResponseWriter, r *http.Request) error {
 	email := r.FormValue("email")
 	passwd := r.FormValue("password")
-	authenticate(w, r, email, passwd)
+	ip := clientIP(r)
+	// The limiter fails open: a Redis outage must not lock everyone out.
+	if err := logins.Allow(ip, email); err != nil {
+		if _, ok := err.(*loginLockedError); ok {
+			return err
+		}
+		log.Printf("Failed to check login attempts: %s", err.Error())
+	}
+	if err := authenticate(w, r, email, passwd); err != nil {
+		if err == ErrAuthentication {
+			if ferr := logins.Fail(ip, email); ferr != nil {
+				log.Printf("Failed to record a failed login: %s", ferr.Error())
+			}
+		}
+		return err
+	}
+	if err := logins.Succeed(email); err != nil {
+		log.Printf("Failed to reset login attempts: %s", err.Error())
+	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
 }
 
-func GetLogout(w http.ResponseWriter, r *http.Request) {
+func GetLogout(w http.ResponseWriter, r *http.Request) error {
 	session := getSession(w, r)
 	delete(session.Values, "user_id")
 	session.Options = &sessions.Options{MaxAge: -1}
 	session.Save(r, w)
 	http.Redirect(w, r, "/login", http.StatusFound)
+	return nil
 }
 
-func GetIndex(w http.ResponseWriter, r *http.Request) {
+func GetIndex(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 
 	user := getCurrentUser(w, r)
 
-	prof := Profile{}
-	row := db.QueryRow(`SELECT * FROM profiles WHERE user_id = ?`, user.ID)
-	err := row.Scan(&prof.UserID, &prof.FirstName, &prof.LastName, &prof.Sex, &prof.Birthday, &prof.Pref, &prof.UpdatedAt)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-
-	rows, err := db.Query(`SELECT * FROM entries WHERE user_id = ? ORDER BY created_at LIMIT 5`, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	entries := make([]Entry, 0, 5)
-	entrie_ids := []string{}
-	for rows.Next() {
-		var id, userID, private int
-		var body string
-		var createdAt time.Time
-		var title string
-		checkErr(rows.Scan(&id, &userID, &private, &body, &createdAt, &title))
-		entries = append(entries, Entry{id, userID, private == 1, title, body, createdAt})
-		entrie_ids = append(entrie_ids, strconv.Itoa(id))
-	}
-	rows.Close()
-
-	stmtGetCommentsForMe := `SELECT * FROM comments WHERE entry_id IN (%s)`
-	rows, err = db.Query(fmt.Sprintf(stmtGetCommentsForMe, strings.Join(entrie_ids, ",")))
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	commentsForMe := make([]Comment, 0, 10)
-	for rows.Next() {
-		c := Comment{}
-		checkErr(rows.Scan(&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt))
-		commentsForMe = append(commentsForMe, c)
-	}
-	rows.Close()
-
-	var friendsCnt int
-	rows, err = db.Query(`SELECT * FROM relations WHERE one = ? OR another = ? ORDER BY created_at DESC`, user.ID, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	friendsMap := make(map[int]time.Time)
-	for rows.Next() {
-		var id, one, another int
-		var createdAt time.Time
-		checkErr(rows.Scan(&id, &one, &another, &createdAt))
-		var friendID int
-		if one == user.ID {
-			friendsCnt += 1
-			friendID = another
-		} else {
-			friendID = one
-		}
-		if _, ok := friendsMap[friendID]; !ok {
-			friendsMap[friendID] = createdAt
-		}
+	prof, err := storage.Profile(user.ID)
+	if err != nil {
+		return err
 	}
 
-	friendIds := make([]int, 0, len(friendsMap))
-	for key := range friendsMap {
-		friendIds = append(friendIds, key)
+	entries, err := storage.EntriesByUser(user.ID, true, false, 5)
+	if err != nil {
+		return err
+	}
+
+	myCommentsPage := pageParam(r, "my_comments_page")
+	commentsForMe, err := commentsForMe(user.ID, myCommentsPage)
+	if err != nil {
+		return err
 	}
-	rows.Close()
 
-	sort.Ints(friendIds)
+	friendsCnt := friendships.FriendCount(user.ID)
 
-	rows, err = db.Query(`SELECT * FROM entries ORDER BY created_at DESC LIMIT 1000`)
-	if err != sql.ErrNoRows {
-		checkErr(err)
+	feed := timeline.Feed(user.ID)
+	feedEntries, err := storage.EntriesByIDs(feed)
+	if err != nil {
+		return err
 	}
-	entriesOfFriends := make([]Entry, 0, 10)
-	for rows.Next() {
-		var id, userID, private int
-		var body string
-		var createdAt time.Time
-		var title string
-		checkErr(rows.Scan(&id, &userID, &private, &body, &createdAt, &title))
-		if !checkFriendFromSlice(friendIds, userID) {
-			continue
-		}
-		entriesOfFriends = append(entriesOfFriends, Entry{id, userID, private == 1, title, body, createdAt})
-		if len(entriesOfFriends) >= 10 {
-			break
+	entriesOfFriends := make([]Entry, 0, len(feed))
+	for _, id := range feed {
+		if entry, ok := feedEntries[id]; ok {
+			entriesOfFriends = append(entriesOfFriends, entry)
 		}
 	}
-	rows.Close()
 
-	rows, err = db.Query(`SELECT * FROM comments ORDER BY created_at DESC LIMIT 1000`)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	commentsOfFriends := make([]Comment, 0, 10)
-	for rows.Next() {
-		c := Comment{}
-		checkErr(rows.Scan(&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt))
-		if !checkFriendFromSlice(friendIds, c.UserID) {
-			continue
-		}
-		row := db.QueryRow(`SELECT * FROM entries WHERE id = ?`, c.EntryID)
-		var id, userID, private int
-		var body string
-		var createdAt time.Time
-		var title string
-		checkErr(row.Scan(&id, &userID, &private, &body, &createdAt, &title))
-		entry := Entry{id, userID, private == 1, title, body, createdAt}
-		if entry.Private {
-			if !permitted(w, r, entry.UserID) {
-				continue
-			}
-		}
-		commentsOfFriends = append(commentsOfFriends, c)
-		if len(commentsOfFriends) >= 10 {
-			break
-		}
+	commentsPage := pageParam(r, "comments_page")
+	commentsOfFriends, err := commentsOfFriends(user.ID, commentsPage)
+	if err != nil {
+		return err
 	}
-	rows.Close()
-
-	rows, err = db.Query(`SELECT user_id, owner_id, DATE(created_at) AS date, MAX(created_at) AS updated
-FROM footprints
-WHERE user_id = ?
-GROUP BY user_id, owner_id, DATE(created_at)
-ORDER BY updated DESC
-LIMIT 10`, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	footprints := make([]Footprint, 0, 10)
-	for rows.Next() {
-		fp := Footprint{}
-		checkErr(rows.Scan(&fp.UserID, &fp.OwnerID, &fp.CreatedAt, &fp.UpdatedAt))
-		footprints = append(footprints, fp)
-	}
-	rows.Close()
-
-	render(w, r, http.StatusOK, "index.html", struct {
-		User              User
-		Profile           Profile
-		Entries           []Entry
-		CommentsForMe     []Comment
-		EntriesOfFriends  []Entry
-		CommentsOfFriends []Comment
-		FriendsCnt        int
-		Footprints        []Footprint
+
+	footprints, err := getFootprints(user.ID, 10)
+	if err != nil {
+		return err
+	}
+
+	return render(w, http.StatusOK, "index.html", struct {
+		User                  User
+		Profile               Profile
+		Entries               []Entry
+		CommentsForMe         []Comment
+		CommentsForMeNext     int
+		EntriesOfFriends      []Entry
+		CommentsOfFriends     []FeedComment
+		CommentsOfFriendsNext int
+		FriendsCnt            int
+		Footprints            []Footprint
 	}{
-		*user, prof, entries, commentsForMe, entriesOfFriends, commentsOfFriends, friendsCnt, footprints,
+		*user, prof, entries, commentsForMe, nextPage(myCommentsPage, len(commentsForMe)), entriesOfFriends, commentsOfFriends, nextPage(commentsPage, len(commentsOfFriends)), friendsCnt, footprints,
 	})
 }
 
-func GetProfile(w http.ResponseWriter, r *http.Request) {
+func GetProfile(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 
 	account := mux.Vars(r)["account_name"]
-	owner := getUserFromAccount(w, account)
-	row := db.QueryRow(`SELECT * FROM profiles WHERE user_id = ?`, owner.ID)
-	prof := Profile{}
-	err := row.Scan(&prof.UserID, &prof.FirstName, &prof.LastName, &prof.Sex, &prof.Birthday, &prof.Pref, &prof.UpdatedAt)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	var query string
-	if permitted(w, r, owner.ID) {
-		query = `SELECT * FROM entries WHERE user_id = ? ORDER BY created_at LIMIT 5`
-	} else {
-		query = `SELECT * FROM entries WHERE user_id = ? AND private=0 ORDER BY created_at LIMIT 5`
-	}
-	rows, err := db.Query(query, owner.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	entries := make([]Entry, 0, 5)
-	for rows.Next() {
-		var id, userID, private int
-		var body string
-		var createdAt time.Time
-		var title string
-		checkErr(rows.Scan(&id, &userID, &private, &body, &createdAt, &title))
-		entry := Entry{id, userID, private == 1, title, body, createdAt}
-		entries = append(entries, entry)
-	}
-	rows.Close()
-
-	markFootprint(w, r, owner.ID)
-
-	render(w, r, http.StatusOK, "profile.html", struct {
-		Owner   User
-		Profile Profile
-		Entries []Entry
-		Private bool
+	owner, err := getUserFromAccount(w, account)
+	if err != nil {
+		return err
+	}
+
+	if err := markFootprint(w, r, owner.ID); err != nil {
+		return err
+	}
+
+	return renderProfile(w, r, owner, http.StatusOK, nil, nil)
+}
+
+// renderProfile shows the profile page of owner. form holds the values of a
+// rejected update, which are shown in the form together with errs.
+func renderProfile(w http.ResponseWriter, r *http.Request, owner *User, status int, form *Profile, errs fieldErrors) error {
+	prof, err := storage.Profile(owner.ID)
+	if err != nil {
+		return err
+	}
+	entries, err := storage.EntriesByUser(owner.ID, permitted(w, r, owner.ID), false, 5)
+	if err != nil {
+		return err
+	}
+	if form == nil {
+		form = &prof
+	}
+	token, err := csrfToken(w, r)
+	if err != nil {
+		return err
+	}
+
+	return render(w, status, "profile.html", struct {
+		CurrentUser *User
+		Owner       User
+		Profile     Profile
+		Entries     []Entry
+		Private     bool
+		IsFriend    bool
+		Form        Profile
+		Errors      fieldErrors
+		CSRFToken   string
 	}{
-		*owner, prof, entries, permitted(w, r, owner.ID),
+		getCurrentUser(w, r), *owner, prof, entries, permitted(w, r, owner.ID), isFriend(w, r, owner.ID), *form, errs, token,
 	})
 }
 
-func PostProfile(w http.ResponseWriter, r *http.Request) {
+func PostProfile(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 	user := getCurrentUser(w, r)
 	account := mux.Vars(r)["account_name"]
 	if account != user.AccountName {
-		checkErr(ErrPermissionDenied)
-	}
-	query := `UPDATE profiles
-SET first_name=?, last_name=?, sex=?, birthday=?, pref=?, updated_at=CURRENT_TIMESTAMP()
-WHERE user_id = ?`
-	birth := r.FormValue("birthday")
-	firstName := r.FormValue("first_name")
-	lastName := r.FormValue("last_name")
-	sex := r.FormValue("sex")
-	pref := r.FormValue("pref")
-	_, err := db.Exec(query, firstName, lastName, sex, birth, pref, user.ID)
-	checkErr(err)
+		return ErrPermissionDenied
+	}
+	prof := Profile{
+		UserID:    user.ID,
+		FirstName: r.FormValue("first_name"),
+		LastName:  r.FormValue("last_name"),
+		Sex:       r.FormValue("sex"),
+		Pref:      r.FormValue("pref"),
+	}
+	if birth, err := time.ParseInLocation("2006-01-02", r.FormValue("birthday"), time.Local); err == nil {
+		prof.Birthday = mysql.NullTime{Time: birth, Valid: true}
+	}
+	if errs := profileRules.validate(r); len(errs) > 0 {
+		return renderProfile(w, r, user, http.StatusBadRequest, &prof, errs)
+	}
+	if err := storage.UpdateProfile(prof); err != nil {
+		return err
+	}
 	// TODO should escape the account name?
 	http.Redirect(w, r, "/profile/"+account, http.StatusSeeOther)
+	return nil
 }
 
-func ListEntries(w http.ResponseWriter, r *http.Request) {
+func ListEntries(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 
 	account := mux.Vars(r)["account_name"]
-	owner := getUserFromAccount(w, account)
-	var query string
-	if permitted(w, r, owner.ID) {
-		query = `SELECT * FROM entries WHERE user_id = ? ORDER BY created_at DESC LIMIT 20`
-	} else {
-		query = `SELECT * FROM entries WHERE user_id = ? AND private=0 ORDER BY created_at DESC LIMIT 20`
+	owner, err := getUserFromAccount(w, account)
+	if err != nil {
+		return err
 	}
-	rows, err := db.Query(query, owner.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
+
+	if err := markFootprint(w, r, owner.ID); err != nil {
+		return err
+	}
+
+	return renderEntries(w, r, owner, http.StatusOK, Entry{}, nil)
+}
+
+// renderEntries shows the entries of owner, with form and errs filling the
+// new entry form after a rejected post.
+func renderEntries(w http.ResponseWriter, r *http.Request, owner *User, status int, form Entry, errs fieldErrors) error {
+	entries, err := storage.EntriesByUser(owner.ID, permitted(w, r, owner.ID), true, 20)
+	if err != nil {
+		return err
 	}
-	entries := make([]Entry, 0, 20)
-	for rows.Next() {
-		var id, userID, private int
-		var body string
-		var createdAt time.Time
-		var title string
-		checkErr(rows.Scan(&id, &userID, &private, &body, &createdAt, &title))
-		entry := Entry{id, userID, private == 1, title, body, createdAt}
-		entries = append(entries, entry)
+	entryIDs := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		entryIDs = append(entryIDs, entry.ID)
+	}
+	numComments, err := storage.CountCommentsByEntries(entryIDs)
+	if err != nil {
+		return err
+	}
+	token, err := csrfToken(w, r)
+	if err != nil {
+		return err
 	}
-	rows.Close()
 
-	markFootprint(w, r, owner.ID)
+	return render(w, status, "entries.html", struct {
+		Owner       *User
+		Entries     []Entry
+		NumComments map[int]int
+		Myself      bool
+		Form        Entry
+		Errors      fieldErrors
+		CSRFToken   string
+	}{owner, entries, numComments, getCurrentUser(w, r).ID == owner.ID, form, errs, token})
+}
 
-	render(w, r, http.StatusOK, "entries.html", struct {
-		Owner   *User
-		Entries []Entry
-		Myself  bool
-	}{owner, entries, getCurrentUser(w, r).ID == owner.ID})
+func getEntryFromVars(r *http.Request) (Entry, error) {
+	entryID, err := strconv.Atoi(mux.Vars(r)["entry_id"])
+	if err != nil {
+		return Entry{}, ErrContentNotFound
+	}
+	return storage.Entry(entryID)
 }
 
-func GetEntry(w http.ResponseWriter, r *http.Request) {
+func GetEntry(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
+	}
+	entry, err := getEntryFromVars(r)
+	if err != nil {
+		return err
+	}
+	owner, err := getUser(w, entry.UserID)
+	if err != nil {
+		return err
 	}
-	entryID := mux.Vars(r)["entry_id"]
-	row := db.QueryRow(`SELECT * FROM entries WHERE id = ?`, entryID)
-	var id, userID, private int
-	var body string
-	var createdAt time.Time
-	var title string
-	err := row.Scan(&id, &userID, &private, &body, &createdAt, &title)
-	if err == sql.ErrNoRows {
-		checkErr(ErrContentNotFound)
-	}
-	checkErr(err)
-	entry := Entry{id, userID, private == 1, title, body, createdAt}
-	owner := getUser(w, entry.UserID)
 	if entry.Private {
 		if !permitted(w, r, owner.ID) {
-			checkErr(ErrPermissionDenied)
+			return ErrPermissionDenied
 		}
 	}
-	rows, err := db.Query(`SELECT * FROM comments WHERE entry_id = ?`, entry.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	comments := make([]Comment, 0, 10)
-	for rows.Next() {
-		c := Comment{}
-		checkErr(rows.Scan(&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt))
-		comments = append(comments, c)
+
+	if err := markFootprint(w, r, owner.ID); err != nil {
+		return err
 	}
-	rows.Close()
 
-	markFootprint(w, r, owner.ID)
+	return renderEntry(w, r, owner, entry, http.StatusOK, Comment{}, entry, nil)
+}
 
-	render(w, r, http.StatusOK, "entry.html", struct {
-		Owner    *User
-		Entry    Entry
-		Comments []Comment
-	}{owner, entry, comments})
+// renderEntry shows entry with its comments. After a rejected post, form or
+// editForm fill the comment form or the owner's edit form, next to errs.
+func renderEntry(w http.ResponseWriter, r *http.Request, owner *User, entry Entry, status int, form Comment, editForm Entry, errs fieldErrors) error {
+	comments, err := storage.CommentsByEntry(entry.ID)
+	if err != nil {
+		return err
+	}
+	token, err := csrfToken(w, r)
+	if err != nil {
+		return err
+	}
+
+	return render(w, status, "entry.html", struct {
+		Owner     *User
+		Entry     Entry
+		Comments  []Comment
+		Form      Comment
+		EditForm  Entry
+		Errors    fieldErrors
+		CSRFToken string
+		Myself    bool
+	}{owner, entry, comments, form, editForm, errs, token, getCurrentUser(w, r).ID == owner.ID})
 }
 
-func PostEntry(w http.ResponseWriter, r *http.Request) {
+func PostEntry(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 
 	user := getCurrentUser(w, r)
 	title := r.FormValue("title")
+	content := r.FormValue("content")
+	private := r.FormValue("private") != ""
+
+	if errs := entryRules.validate(r); len(errs) > 0 {
+		form := Entry{UserID: user.ID, Private: private, Title: title, Content: content}
+		return renderEntries(w, r, user, http.StatusBadRequest, form, errs)
+	}
 	if title == "" {
 		title = "タイトルなし"
 	}
-	content := r.FormValue("content")
-	var private int
-	if r.FormValue("private") == "" {
-		private = 0
-	} else {
-		private = 1
-	}
 
-	_, err := db.Exec(`INSERT INTO entries (user_id, private, body, title) VALUES (?,?,?,?)`, user.ID, private, content, title)
-	checkErr(err)
+	id, err := storage.CreateEntry(user.ID, private, title, content)
+	if err != nil {
+		return err
+	}
+	timeline.AddEntry(Entry{ID: id, UserID: user.ID, CreatedAt: now()}, friendships.FriendsOf(user.ID))
 	http.Redirect(w, r, "/diary/entries/"+user.AccountName, http.StatusSeeOther)
+	return nil
 }
 
-func PostComment(w http.ResponseWriter, r *http.Request) {
+// getOwnEntryFromVars returns the entry of the URL if the current user wrote it.
+func getOwnEntryFromVars(w http.ResponseWriter, r *http.Request) (Entry, error) {
+	entry, err := getEntryFromVars(r)
+	if err != nil {
+		return Entry{}, err
+	}
+	if entry.UserID != getCurrentUser(w, r).ID {
+		return Entry{}, ErrPermissionDenied
+	}
+	return entry, nil
+}
+
+func PostEditEntry(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
+	}
+
+	entry, err := getOwnEntryFromVars(w, r)
+	if err != nil {
+		return err
+	}
+	user := getCurrentUser(w, r)
+	edited := entry
+	edited.Title = r.FormValue("title")
+	edited.Content = r.FormValue("content")
+	edited.Private = r.FormValue("private") != ""
+
+	if errs := entryRules.validate(r); len(errs) > 0 {
+		return renderEntry(w, r, user, entry, http.StatusBadRequest, Comment{}, edited, errs)
+	}
+	if edited.Title == "" {
+		edited.Title = "タイトルなし"
+	}
+
+	// The timeline only keeps ids and creation times, so it is not affected.
+	if err := storage.UpdateEntry(edited); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/diary/entry/"+strconv.Itoa(entry.ID), http.StatusSeeOther)
+	return nil
+}
+
+func PostDeleteEntry(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+
+	entry, err := getOwnEntryFromVars(w, r)
+	if err != nil {
+		return err
 	}
+	user := getCurrentUser(w, r)
 
-	entryID := mux.Vars(r)["entry_id"]
-	row := db.QueryRow(`SELECT * FROM entries WHERE id = ?`, entryID)
-	var id, userID, private int
-	var body string
-	var createdAt time.Time
-	var title string
-	err := row.Scan(&id, &userID, &private, &body, &createdAt, &title)
-	if err == sql.ErrNoRows {
-		checkErr(ErrContentNotFound)
+	if err := storage.DeleteEntry(entry.ID); err != nil {
+		return err
+	}
+	recent, err := storage.EntriesByUser(user.ID, true, true, timelineSize)
+	if err != nil {
+		return err
 	}
-	checkErr(err)
+	timeline.RemoveEntry(user.ID, entry.ID, recent, friendships)
+	http.Redirect(w, r, "/diary/entries/"+user.AccountName, http.StatusSeeOther)
+	return nil
+}
 
-	entry := Entry{id, userID, private == 1, title, body, createdAt}
-	owner := getUser(w, entry.UserID)
+func PostComment(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+
+	entry, err := getEntryFromVars(r)
+	if err != nil {
+		return err
+	}
+	owner, err := getUser(w, entry.UserID)
+	if err != nil {
+		return err
+	}
 	if entry.Private {
 		if !permitted(w, r, owner.ID) {
-			checkErr(ErrPermissionDenied)
+			return ErrPermissionDenied
 		}
 	}
 	user := getCurrentUser(w, r)
+	comment := r.FormValue("comment")
 
-	_, err = db.Exec(`INSERT INTO comments (entry_id, user_id, comment) VALUES (?,?,?)`, entry.ID, user.ID, r.FormValue("comment"))
-	checkErr(err)
+	if errs := commentRules.validate(r); len(errs) > 0 {
+		form := Comment{EntryID: entry.ID, UserID: user.ID, Comment: comment}
+		return renderEntry(w, r, owner, entry, http.StatusBadRequest, form, entry, errs)
+	}
+
+	if _, err := storage.CreateComment(entry.ID, user.ID, comment); err != nil {
+		return err
+	}
 	http.Redirect(w, r, "/diary/entry/"+strconv.Itoa(entry.ID), http.StatusSeeOther)
+	return nil
 }
 
-func GetFootprints(w http.ResponseWriter, r *http.Request) {
+func GetFootprints(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 
 	user := getCurrentUser(w, r)
-	footprints := make([]Footprint, 0, 50)
-	rows, err := db.Query(`SELECT user_id, owner_id, DATE(created_at) AS date, MAX(created_at) as updated
-FROM footprints
-WHERE user_id = ?
-GROUP BY user_id, owner_id, DATE(created_at)
-ORDER BY updated DESC
-LIMIT 50`, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	for rows.Next() {
-		fp := Footprint{}
-		checkErr(rows.Scan(&fp.UserID, &fp.OwnerID, &fp.CreatedAt, &fp.UpdatedAt))
-		footprints = append(footprints, fp)
-	}
-	rows.Close()
-	render(w, r, http.StatusOK, "footprints.html", struct{ Footprints []Footprint }{footprints})
-}
-func GetFriends(w http.ResponseWriter, r *http.Request) {
+	footprints, err := getFootprints(user.ID, 50)
+	if err != nil {
+		return err
+	}
+	return render(w, http.StatusOK, "footprints.html", struct{ Footprints []Footprint }{footprints})
+}
+
+func GetFriends(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 
 	user := getCurrentUser(w, r)
-	rows, err := db.Query(`SELECT * FROM relations WHERE one = ? OR another = ? ORDER BY created_at DESC`, user.ID, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	friendsMap := make(map[int]time.Time)
-	for rows.Next() {
-		var id, one, another int
-		var createdAt time.Time
-		checkErr(rows.Scan(&id, &one, &another, &createdAt))
-		var friendID int
-		if one == user.ID {
-			friendID = another
-		} else {
-			friendID = one
-		}
-		if _, ok := friendsMap[friendID]; !ok {
-			friendsMap[friendID] = createdAt
-		}
-	}
-	rows.Close()
-	friends := make([]Friend, 0, len(friendsMap))
-	for key, val := range friendsMap {
-		friends = append(friends, Friend{key, val})
-	}
-	render(w, r, http.StatusOK, "friends.html", struct{ Friends []Friend }{friends})
+	friends := friendships.FriendsOf(user.ID)
+	return render(w, http.StatusOK, "friends.html", struct{ Friends []Friend }{friends})
 }
 
-func PostFriends(w http.ResponseWriter, r *http.Request) {
+func PostFriends(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 
 	user := getCurrentUser(w, r)
 	anotherAccount := mux.Vars(r)["account_name"]
-	if !isFriendAccount(w, r, anotherAccount) {
-		another := getUserFromAccount(w, anotherAccount)
-		_, err := db.Exec(`INSERT INTO relations (one, another) VALUES (?,?), (?,?)`, user.ID, another.ID, another.ID, user.ID)
-		checkErr(err)
-		http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	another, err := getUserFromAccount(w, anotherAccount)
+	if err != nil {
+		return err
 	}
+	if isFriend(w, r, another.ID) {
+		return ErrConflict
+	}
+	if err := storage.AddFriend(user.ID, another.ID); err != nil {
+		return err
+	}
+	friendships.Add(user.ID, another.ID, now())
+	timeline.AddFriend(user.ID, another.ID)
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	return nil
 }
 
-func GetInitialize(w http.ResponseWriter, r *http.Request) {
-	db.Exec("DELETE FROM relations WHERE id > 500000")
-	db.Exec("DELETE FROM footprints WHERE id > 500000")
-	db.Exec("DELETE FROM entries WHERE id > 500000")
-	db.Exec("DELETE FROM comments WHERE id > 1500000")
+func GetInitialize(w http.ResponseWriter, r *http.Request) error {
+	if err := storage.Reset(); err != nil {
+		return err
+	}
+
+	us, err := storage.Users()
+	if err != nil {
+		return err
+	}
+	salts, err := storage.Salts()
+	if err != nil {
+		return err
+	}
+	users.Load(us, salts)
+
+	rels, err := storage.Relations()
+	if err != nil {
+		return err
+	}
+	friendships.Load(rels)
 
-	rows, _ := db.Query(`SELECT * FROM users`)
-	users = map[int]User{}
-	for rows.Next() {
-		u := User{}
-		checkErr(rows.Scan(&u.ID, &u.AccountName, &u.NickName, &u.Email, &u.PassHash))
-		users[u.ID] = u
+	recent, err := storage.RecentEntriesByUser(timelineSize)
+	if err != nil {
+		return err
 	}
-	rows.Close()
+	timeline.Load(recent, friendships)
 
-	rows, _ = db.Query(`SELECT * FROM salts`)
-	salts = map[int]string{}
-	for rows.Next() {
-		var id int
-		var s string
-		checkErr(rows.Scan(&id, &s))
-		salts[id] = s
+	if err := InitializeFootprints(); err != nil {
+		log.Printf("Failed to build footprints cache, reading them from MySQL: %s", err.Error())
 	}
-	rows.Close()
+	return nil
 }
 
 func main() {
@@ -880,34 +825,70 @@ func main() {
 	}
 	defer db.Close()
 
+	storage = NewMySQLStore(db)
+
 	redisHost := os.Getenv("ISUCON5_REDIS_HOST")
 	if redisHost == "" {
 		redisHost = "localhost"
 	}
 
+	redisMaxIdle := getEnvInt("ISUCON5_REDIS_MAX_IDLE", 32)
+	redisMaxActive := getEnvInt("ISUCON5_REDIS_MAX_ACTIVE", 128)
+	redisConnectTimeout := time.Duration(getEnvInt("ISUCON5_REDIS_CONNECT_TIMEOUT_MS", 1000)) * time.Millisecond
+	redisTimeout := time.Duration(getEnvInt("ISUCON5_REDIS_TIMEOUT_MS", 500)) * time.Millisecond
+
 	redisUseTcp := os.Getenv("ISUCON5_REDIS_USE_TCP")
 	if redisUseTcp == "0" {
-		redisConn, err = redis.Dial("unix", "/var/run/redis/redis.sock")
-		if err != nil {
+		redisPool = newRedisPool("unix", "/var/run/redis/redis.sock", redisMaxIdle, redisMaxActive, redisConnectTimeout, redisTimeout)
+		if err := pingRedis(); err != nil {
 			log.Fatalf("Failed to connect to Redis with Unix domain socket: %s.", err.Error())
 		}
 	} else {
-		redisConn, err = redis.Dial("tcp", fmt.Sprintf("%v:6379", redisHost))
-		if err != nil {
+		redisPool = newRedisPool("tcp", fmt.Sprintf("%v:6379", redisHost), redisMaxIdle, redisMaxActive, redisConnectTimeout, redisTimeout)
+		if err := pingRedis(); err != nil {
 			log.Fatalf("Failed to connect to Redis with TCP: %s.", err.Error())
 		}
 	}
-	defer redisConn.Close()
+	defer redisPool.Close()
+
+	if os.Getenv("ISUCON5_LOGIN_LIMIT_STORE") == "redis" {
+		logins = newLoginLimiter(&redisAttempts{})
+	}
 
-	store = sessions.NewCookieStore([]byte(ssecret))
+	loadTemplates()
+	startFootprintCompaction(time.Duration(getEnvInt("ISUCON5_FOOTPRINT_COMPACT_INTERVAL", 600)) * time.Second)
+
+	switch os.Getenv("ISUCON5_SESSION_STORE") {
+	case "redis":
+		store = newServerStore(redisSessions{}, sessionKeyPairs(ssecret)...)
+	case "mysql":
+		st := newServerStore(sqlSessions{db}, sessionKeyPairs(ssecret)...)
+		startSessionSweep(st, time.Duration(getEnvInt("ISUCON5_SESSION_SWEEP_INTERVAL", 600))*time.Second)
+		store = st
+	default:
+		store = sessions.NewCookieStore(sessionKeyPairs(ssecret)...)
+	}
 
 	r := mux.NewRouter()
+	// csrfProtect runs for every route, including those of the subrouters.
+	r.Use(csrfProtect)
 
 	l := r.Path("/login").Subrouter()
 	l.Methods("GET").HandlerFunc(myHandler(GetLogin))
 	l.Methods("POST").HandlerFunc(myHandler(PostLogin))
 	r.Path("/logout").Methods("GET").HandlerFunc(myHandler(GetLogout))
 
+	s := r.Path("/signup").Subrouter()
+	s.Methods("GET").HandlerFunc(myHandler(GetSignup))
+	s.Methods("POST").HandlerFunc(myHandler(PostSignup))
+
+	a := r.PathPrefix("/account").Subrouter()
+	a.HandleFunc("", myHandler(GetAccount)).Methods("GET")
+	a.HandleFunc("/email", myHandler(PostAccountEmail)).Methods("POST")
+	a.HandleFunc("/password", myHandler(PostAccountPassword)).Methods("POST")
+	a.HandleFunc("/nick_name", myHandler(PostAccountNickName)).Methods("POST")
+	a.HandleFunc("/logout_all", myHandler(PostAccountLogoutAll)).Methods("POST")
+
 	p := r.Path("/profile/{account_name}").Subrouter()
 	p.Methods("GET").HandlerFunc(myHandler(GetProfile))
 	p.Methods("POST").HandlerFunc(myHandler(PostProfile))
@@ -916,6 +897,8 @@ func main() {
 	d.HandleFunc("/entries/{account_name}", myHandler(ListEntries)).Methods("GET")
 	d.HandleFunc("/entry", myHandler(PostEntry)).Methods("POST")
 	d.HandleFunc("/entry/{entry_id}", myHandler(GetEntry)).Methods("GET")
+	d.HandleFunc("/entry/{entry_id}/edit", myHandler(PostEditEntry)).Methods("POST")
+	d.HandleFunc("/entry/{entry_id}/delete", myHandler(PostDeleteEntry)).Methods("POST")
 
 	d.HandleFunc("/comment/{entry_id}", myHandler(PostComment)).Methods("POST")
 
@@ -927,15 +910,10 @@ func main() {
 	r.HandleFunc("/initialize", myHandler(GetInitialize))
 	r.HandleFunc("/", myHandler(GetIndex))
 
+	http.HandleFunc("/debug/footprints", GetFootprintsDiff)
 	go func() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
 	}()
 
 	log.Fatal(http.ListenAndServe(":8080", r))
 }
-
-func checkErr(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// newTestApp points the handlers at a memoryStore holding alice (1) and
+// bob (2), who are not friends yet. Redis is never reached: the footprint
+// cache stays off and logins are throttled in memory.
+func newTestApp(t *testing.T) *memoryStore {
+	t.Helper()
+	ms := NewMemoryStore()
+	ms.AddUser(User{ID: 1, AccountName: "alice", NickName: "Alice", Email: "alice@example.com"}, "salt01")
+	ms.AddUser(User{ID: 2, AccountName: "bob", NickName: "Bob", Email: "bob@example.com"}, "salt02")
+	storage = ms
+
+	all, _ := ms.Users()
+	salts, _ := ms.Salts()
+	users = newUserDirectory()
+	users.Load(all, salts)
+	friendships = newFriendGraph()
+	timeline = newEntryTimeline()
+	logins = newLoginLimiter(newMemoryAttempts())
+	currentHasher = bcryptHasher{cost: 4}
+	passwordHashers = []passwordHasher{currentHasher, legacyHasher{}}
+	store = sessions.NewCookieStore([]byte("test-secret"))
+	loadTemplates()
+	return ms
+}
+
+// serve runs h for a request as userID, or anonymously when it is 0.
+// CSRF is checked by csrfProtect, which has its own tests.
+func serve(h func(http.ResponseWriter, *http.Request) error, method, path string, vars map[string]string, form url.Values, userID int) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	r = mux.SetURLVars(r, vars)
+	if userID != 0 {
+		w := httptest.NewRecorder()
+		session, _ := store.New(r, "isucon5q-go.session")
+		session.Values["user_id"] = userID
+		session.Save(r, w)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+	}
+	w := httptest.NewRecorder()
+	myHandler(h)(w, r)
+	return w
+}
+
+func TestAuthenticatedPagesRedirectToLogin(t *testing.T) {
+	newTestApp(t)
+	w := serve(GetIndex, "GET", "/", nil, nil, 0)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login" {
+		t.Errorf("GET / = %d %q, want a redirect to /login", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestGetIndex(t *testing.T) {
+	newTestApp(t)
+	w := serve(GetIndex, "GET", "/", nil, nil, 1)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Alice") {
+		t.Errorf("GET / = %d, want 200 with the nick name", w.Code)
+	}
+}
+
+func TestGetProfileOfUnknownAccount(t *testing.T) {
+	newTestApp(t)
+	w := serve(GetProfile, "GET", "/profile/nobody", map[string]string{"account_name": "nobody"}, nil, 1)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET /profile/nobody = %d, want 404", w.Code)
+	}
+}
+
+func TestGetProfileLeavesFootprint(t *testing.T) {
+	ms := newTestApp(t)
+	serve(GetProfile, "GET", "/profile/bob", map[string]string{"account_name": "bob"}, nil, 1)
+	fps, _ := ms.Footprints(2, 10)
+	if len(fps) != 1 || fps[0].OwnerID != 1 {
+		t.Errorf("footprints of bob = %v, want one by alice", fps)
+	}
+}
+
+func TestPostProfile(t *testing.T) {
+	ms := newTestApp(t)
+	vars := map[string]string{"account_name": "alice"}
+	form := url.Values{"first_name": {"あり"}, "last_name": {"す"}, "sex": {"女性"}, "birthday": {"1990-04-01"}, "pref": {"東京都"}}
+
+	if w := serve(PostProfile, "POST", "/profile/alice", vars, form, 2); w.Code != http.StatusForbidden {
+		t.Errorf("editing another profile = %d, want 403", w.Code)
+	}
+
+	w := serve(PostProfile, "POST", "/profile/alice", vars, form, 1)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST /profile/alice = %d, want 303: %s", w.Code, w.Body)
+	}
+	prof, _ := ms.Profile(1)
+	if prof.Pref != "東京都" || prof.Sex != "女性" || !prof.Birthday.Valid {
+		t.Errorf("profile = %+v", prof)
+	}
+}
+
+func TestPostProfileShowsFieldErrors(t *testing.T) {
+	newTestApp(t)
+	form := url.Values{"sex": {"秘密"}, "birthday": {"1990/04/01"}, "pref": {"東京"}}
+	w := serve(PostProfile, "POST", "/profile/alice", map[string]string{"account_name": "alice"}, form, 1)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("POST /profile/alice = %d, want 400", w.Code)
+	}
+	if n := strings.Count(w.Body.String(), "text-danger"); n != 3 {
+		t.Errorf("got %d field errors, want 3 (sex, birthday, pref)", n)
+	}
+}
+
+func TestPostEntryAndComment(t *testing.T) {
+	ms := newTestApp(t)
+	w := serve(PostEntry, "POST", "/diary/entry", nil, url.Values{"title": {"today"}, "content": {"hello"}}, 1)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST /diary/entry = %d, want 303: %s", w.Code, w.Body)
+	}
+	entries, _ := ms.EntriesByUser(1, true, true, 10)
+	if len(entries) != 1 || entries[0].Title != "today" {
+		t.Fatalf("entries of alice = %+v", entries)
+	}
+	id := strconv.Itoa(entries[0].ID)
+	vars := map[string]string{"entry_id": id}
+
+	if w := serve(PostComment, "POST", "/diary/comment/"+id, vars, url.Values{"comment": {" "}}, 2); w.Code != http.StatusBadRequest {
+		t.Errorf("blank comment = %d, want 400", w.Code)
+	}
+	if w := serve(PostComment, "POST", "/diary/comment/"+id, vars, url.Values{"comment": {"nice"}}, 2); w.Code != http.StatusSeeOther {
+		t.Errorf("POST /diary/comment = %d, want 303: %s", w.Code, w.Body)
+	}
+	if comments, _ := ms.CommentsByEntry(entries[0].ID); len(comments) != 1 {
+		t.Errorf("comments = %+v, want one", comments)
+	}
+}
+
+func TestPostEntryRejectsLongTitle(t *testing.T) {
+	newTestApp(t)
+	w := serve(PostEntry, "POST", "/diary/entry", nil, url.Values{"title": {strings.Repeat("あ", 192)}}, 1)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST /diary/entry = %d, want 400", w.Code)
+	}
+}
+
+func TestPrivateEntryNeedsFriendship(t *testing.T) {
+	ms := newTestApp(t)
+	id, _ := ms.CreateEntry(1, true, "secret", "body")
+	vars := map[string]string{"entry_id": strconv.Itoa(id)}
+
+	if w := serve(GetEntry, "GET", "/diary/entry/1", vars, nil, 2); w.Code != http.StatusForbidden {
+		t.Errorf("private entry of a stranger = %d, want 403", w.Code)
+	}
+	serve(PostFriends, "POST", "/friends/alice", map[string]string{"account_name": "alice"}, url.Values{}, 2)
+	if w := serve(GetEntry, "GET", "/diary/entry/1", vars, nil, 2); w.Code != http.StatusOK {
+		t.Errorf("private entry of a friend = %d, want 200", w.Code)
+	}
+}
+
+func TestPostFriendsTwice(t *testing.T) {
+	newTestApp(t)
+	vars := map[string]string{"account_name": "bob"}
+	if w := serve(PostFriends, "POST", "/friends/bob", vars, url.Values{}, 1); w.Code != http.StatusSeeOther {
+		t.Fatalf("POST /friends/bob = %d, want 303", w.Code)
+	}
+	if !friendships.IsFriend(1, 2) || !friendships.IsFriend(2, 1) {
+		t.Error("alice and bob are not friends")
+	}
+	if w := serve(PostFriends, "POST", "/friends/bob", vars, url.Values{}, 1); w.Code != http.StatusConflict {
+		t.Errorf("second POST /friends/bob = %d, want 409", w.Code)
+	}
+}
+
+func TestEditAndDeleteEntry(t *testing.T) {
+	ms := newTestApp(t)
+	id, _ := ms.CreateEntry(1, false, "title", "body")
+	ms.CreateComment(id, 2, "hi")
+	path := "/diary/entry/" + strconv.Itoa(id)
+	vars := map[string]string{"entry_id": strconv.Itoa(id)}
+	form := url.Values{"title": {"edited"}, "content": {"new body"}, "private": {"on"}}
+
+	if w := serve(PostEditEntry, "POST", path+"/edit", vars, form, 2); w.Code != http.StatusForbidden {
+		t.Errorf("editing another user's entry = %d, want 403", w.Code)
+	}
+	if w := serve(PostEditEntry, "POST", path+"/edit", vars, form, 1); w.Code != http.StatusSeeOther {
+		t.Fatalf("POST %s/edit = %d, want 303: %s", path, w.Code, w.Body)
+	}
+	e, _ := ms.Entry(id)
+	if e.Title != "edited" || !e.Private || !e.UpdatedAt.Valid {
+		t.Errorf("entry = %+v", e)
+	}
+
+	if w := serve(PostDeleteEntry, "POST", path+"/delete", vars, url.Values{}, 1); w.Code != http.StatusSeeOther {
+		t.Fatalf("POST %s/delete = %d, want 303", path, w.Code)
+	}
+	if w := serve(GetEntry, "GET", path, vars, nil, 1); w.Code != http.StatusNotFound {
+		t.Errorf("deleted entry = %d, want 404", w.Code)
+	}
+	if comments, _ := ms.CommentsByEntry(id); len(comments) != 0 {
+		t.Errorf("comments of the deleted entry = %+v", comments)
+	}
+}
+
+func TestPostLoginLocksAccount(t *testing.T) {
+	newTestApp(t)
+	logins.MaxPerEmail = 3
+	form := url.Values{"email": {"alice@example.com"}, "password": {"wrong"}}
+	for i := 0; i < 3; i++ {
+		if w := serve(PostLogin, "POST", "/login", nil, form, 0); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d = %d, want 401", i+1, w.Code)
+		}
+	}
+	w := serve(PostLogin, "POST", "/login", nil, form, 0)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("login after the limit = %d, want 429 with Retry-After", w.Code)
+	}
+	other := url.Values{"email": {"bob@example.com"}, "password": {"wrong"}}
+	if w := serve(PostLogin, "POST", "/login", nil, other, 0); w.Code != http.StatusUnauthorized {
+		t.Errorf("login to another account = %d, want 401", w.Code)
+	}
+}
+
+func TestSignupAndAccountSettings(t *testing.T) {
+	newTestApp(t)
+	bad := url.Values{"account_name": {"alice"}, "nick_name": {"C"}, "email": {"nope"}, "password": {"short"}}
+	if w := serve(PostSignup, "POST", "/signup", nil, bad, 0); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid signup = %d, want 400", w.Code)
+	}
+
+	form := url.Values{"account_name": {"carol"}, "nick_name": {"Carol"}, "email": {"carol@example.com"}, "password": {"password1"}}
+	if w := serve(PostSignup, "POST", "/signup", nil, form, 0); w.Code != http.StatusSeeOther {
+		t.Fatalf("POST /signup = %d, want 303: %s", w.Code, w.Body)
+	}
+	carol, ok := users.ByAccountName("carol")
+	if !ok || !checkPassword(carol, "password1") {
+		t.Fatal("carol can't log in after signup")
+	}
+
+	serve(PostAccountEmail, "POST", "/account/email", nil, url.Values{"email": {"c@example.com"}, "email_password": {"password1"}}, carol.ID)
+	serve(PostAccountPassword, "POST", "/account/password", nil, url.Values{"current_password": {"password1"}, "new_password": {"password2"}}, carol.ID)
+	serve(PostAccountNickName, "POST", "/account/nick_name", nil, url.Values{"nick_name": {"Caroline"}}, carol.ID)
+
+	carol, _ = users.ByID(carol.ID)
+	if carol.Email != "c@example.com" || carol.NickName != "Caroline" || !checkPassword(carol, "password2") {
+		t.Errorf("account settings were not all kept: %+v", carol)
+	}
+	stored, _, _ := storage.User(carol.ID)
+	if stored != carol {
+		t.Errorf("store has %+v, directory has %+v", stored, carol)
+	}
+}
+
+func TestWriteErrorHidesInternalErrors(t *testing.T) {
+	newTestApp(t)
+	w := serve(func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New("dial tcp 10.0.0.5:3306: connection refused")
+	}, "GET", "/", nil, nil, 0)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want 500", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "10.0.0.5") {
+		t.Errorf("response leaks the error: %q", w.Body)
+	}
+}
+
+func TestPostProfileWithoutBirthday(t *testing.T) {
+	ms := newTestApp(t)
+	form := url.Values{"first_name": {"あり"}, "sex": {"未指定"}, "birthday": {""}, "pref": {"東京都"}}
+	w := serve(PostProfile, "POST", "/profile/alice", map[string]string{"account_name": "alice"}, form, 1)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST /profile/alice = %d, want 303: %s", w.Code, w.Body)
+	}
+	if prof, _ := ms.Profile(1); prof.Birthday.Valid || prof.Pref != "東京都" {
+		t.Errorf("profile = %+v, want no birthday", prof)
+	}
+}
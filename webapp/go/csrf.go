@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	csrfSessionKey = "csrf_token"
+	csrfFormField  = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+// csrfExempt lists the paths that accept unsafe requests without a token.
+// The benchmarker calls /initialize without a session.
+var csrfExempt = map[string]bool{
+	"/initialize": true,
+}
+
+// csrfToken returns the token of the session, creating one if needed.
+// Pages with a form pass it to the template, which sends it back in the
+// hidden csrf_token field.
+func csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	session := getSession(w, r)
+	if token, ok := session.Values[csrfSessionKey].(string); ok && token != "" {
+		return token, nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	session.Values[csrfSessionKey] = token
+	if err := session.Save(r, w); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// csrfProtect rejects unsafe requests whose token doesn't match the one
+// stored in the session.
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if safeMethod(r.Method) || csrfExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		want, _ := getSession(w, r).Values[csrfSessionKey].(string)
+		got := r.Header.Get(csrfHeader)
+		if got == "" {
+			got = r.PostFormValue(csrfFormField)
+		}
+		if want == "" || subtle.ConstantTimeCompare([]byte(want), []byte(got)) != 1 {
+			writeError(w, r, ErrInvalidCSRFToken)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
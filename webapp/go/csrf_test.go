@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+var csrfPassed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+})
+
+// sessionWithToken returns the cookies of a session holding a CSRF token.
+func sessionWithToken(t *testing.T) ([]*http.Cookie, string) {
+	w := httptest.NewRecorder()
+	token, err := csrfToken(w, httptest.NewRequest("GET", "/login", nil))
+	if err != nil {
+		t.Fatalf("csrfToken: %v", err)
+	}
+	return w.Result().Cookies(), token
+}
+
+func postForm(path string, form url.Values, cookies []*http.Cookie) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestCSRFProtect(t *testing.T) {
+	store = sessions.NewCookieStore([]byte("test-secret"))
+	loadTemplates()
+	cookies, token := sessionWithToken(t)
+	_, otherToken := sessionWithToken(t)
+	withHeader := postForm("/diary/entry", url.Values{}, cookies)
+	withHeader.Header.Set(csrfHeader, token)
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		code int
+	}{
+		{"GET", httptest.NewRequest("GET", "/", nil), http.StatusNoContent},
+		{"no session", postForm("/diary/entry", url.Values{"csrf_token": {token}}, nil), http.StatusForbidden},
+		{"no token", postForm("/diary/entry", url.Values{}, cookies), http.StatusForbidden},
+		{"token of another session", postForm("/diary/entry", url.Values{"csrf_token": {otherToken}}, cookies), http.StatusForbidden},
+		{"form token", postForm("/diary/entry", url.Values{"csrf_token": {token}}, cookies), http.StatusNoContent},
+		{"header token", withHeader, http.StatusNoContent},
+		{"exempt path", postForm("/initialize", url.Values{}, nil), http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		csrfProtect(csrfPassed).ServeHTTP(w, tt.r)
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+}
+
+func TestCSRFTokenIsKeptPerSession(t *testing.T) {
+	store = sessions.NewCookieStore([]byte("test-secret"))
+	cookies, token := sessionWithToken(t)
+
+	r := httptest.NewRequest("GET", "/login", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	again, err := csrfToken(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("csrfToken: %v", err)
+	}
+	if again != token {
+		t.Errorf("token changed within a session: %q, then %q", token, again)
+	}
+}
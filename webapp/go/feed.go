@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// commentsPerPage is the page size of the comment feeds on the index page.
+const commentsPerPage = 10
+
+// FeedComment is a comment together with the owner of the entry it was
+// posted on.
+type FeedComment struct {
+	Comment
+	EntryOwnerID int
+}
+
+// commentsForMe returns the page-th page (0-based) of comments posted on
+// any entry of userID, newest first.
+func commentsForMe(userID, page int) ([]Comment, error) {
+	return storage.CommentsForOwner(userID, commentsPerPage, page*commentsPerPage)
+}
+
+// commentsOfFriends returns the page-th page (0-based) of comments written
+// by friends of viewerID on entries viewerID is permitted to read, newest first.
+func commentsOfFriends(viewerID, page int) ([]FeedComment, error) {
+	friends := friendships.FriendsOf(viewerID)
+	if len(friends) == 0 {
+		return []FeedComment{}, nil
+	}
+	friendIDs := make([]int, 0, len(friends))
+	for _, f := range friends {
+		friendIDs = append(friendIDs, f.ID)
+	}
+	return storage.CommentsOfFriends(viewerID, friendIDs, commentsPerPage, page*commentsPerPage)
+}
+
+// maxCommentPage caps pageParam, so page*commentsPerPage can't overflow
+// into a negative OFFSET.
+const maxCommentPage = 1000
+
+// pageParam reads a 0-based page number from the query string.
+func pageParam(r *http.Request, name string) int {
+	page, err := strconv.Atoi(r.FormValue(name))
+	if err != nil || page < 0 {
+		return 0
+	}
+	if page > maxCommentPage {
+		return maxCommentPage
+	}
+	return page
+}
+
+// nextPage returns the number of the page after page, or 0 when page was
+// not full and there is nothing more to show.
+func nextPage(page, n int) int {
+	if n < commentsPerPage {
+		return 0
+	}
+	return page + 1
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPageParam(t *testing.T) {
+	tests := map[string]int{
+		"":                   0,
+		"x":                  0,
+		"-1":                 0,
+		"3":                  3,
+		"922337203685477581": maxCommentPage,
+	}
+	for value, want := range tests {
+		r := httptest.NewRequest("GET", "/?comments_page="+value, nil)
+		if got := pageParam(r, "comments_page"); got != want {
+			t.Errorf("pageParam(%q) = %d, want %d", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	redis "github.com/garyburd/redigo/redis"
+)
+
+// Each user has a sorted set of the visits to their pages. A member is
+// "<owner_id>:<yyyy-mm-dd>", so a second visit on the same day only moves
+// its score, like GROUP BY user_id, owner_id, DATE(created_at) in MySQL.
+// The score is the negated time of the latest visit, so ZRANGE returns the
+// newest first.
+
+// footprintLocation decides where a day starts when grouping footprints.
+// It should match the time zone MySQL uses for DATE(created_at).
+var footprintLocation = loadFootprintLocation()
+
+// footprintCacheErrors counts Redis failures that made a request fall back
+// to MySQL.
+var footprintCacheErrors = expvar.NewInt("footprints_cache_errors")
+
+func loadFootprintLocation() *time.Location {
+	name := os.Getenv("ISUCON5_FOOTPRINT_TZ")
+	if name == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Fatalf("Failed to load time zone from ISUCON5_FOOTPRINT_TZ: %s.", err.Error())
+	}
+	return loc
+}
+
+func footprintDay(t time.Time) string {
+	return t.In(footprintLocation).Format("2006-01-02")
+}
+
+// footprintsCached is set once /initialize has rebuilt the sorted sets.
+// Until then, or after a failed write, footprints are read from MySQL.
+var footprintsCached int32
+
+// footprintsRebuilding is set while InitializeFootprints runs. Visits are
+// written through during the rebuild too, so those made after it read
+// MySQL still reach Redis. A failed write clears it, and the rebuild then
+// leaves the cache off.
+var footprintsRebuilding int32
+
+// zaddNewer adds a visit unless its member already has a newer one, i.e. a
+// smaller score. The rebuild and the write through can then run in any
+// order without moving a footprint back to an older visit.
+var zaddNewer = redis.NewScript(1, `
+local score = redis.call('ZSCORE', KEYS[1], ARGV[2])
+if not score or tonumber(ARGV[1]) < tonumber(score) then
+  return redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+end
+return 0`)
+
+func footprintKey(userID int) string {
+	return fmt.Sprintf("footprints:user_id:%d", userID)
+}
+
+func footprintMember(ownerID int, day string) string {
+	return fmt.Sprintf("%d:%s", ownerID, day)
+}
+
+func parseFootprintMember(userID int, member string, score float64) (Footprint, error) {
+	parts := strings.SplitN(member, ":", 2)
+	if len(parts) != 2 {
+		return Footprint{}, fmt.Errorf("malformed footprint member %q", member)
+	}
+	ownerID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Footprint{}, err
+	}
+	day, err := time.ParseInLocation("2006-01-02", parts[1], footprintLocation)
+	if err != nil {
+		return Footprint{}, err
+	}
+	return Footprint{
+		UserID:    userID,
+		OwnerID:   ownerID,
+		CreatedAt: day,
+		UpdatedAt: time.Unix(int64(-score), 0),
+	}, nil
+}
+
+// ===== Redis Seed Start =====
+func InitializeFootprints() error {
+	atomic.StoreInt32(&footprintsCached, 0)
+	atomic.StoreInt32(&footprintsRebuilding, 1)
+	if err := rebuildFootprints(); err != nil {
+		atomic.StoreInt32(&footprintsRebuilding, 0)
+		return err
+	}
+	if atomic.CompareAndSwapInt32(&footprintsRebuilding, 1, 0) {
+		atomic.StoreInt32(&footprintsCached, 1)
+	}
+	return nil
+}
+
+// rebuildFootprints clears the sorted sets before reading MySQL, so that
+// a visit is either in the snapshot or written through after the clear.
+func rebuildFootprints() error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("KEYS", "footprints:user_id:*"))
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		if _, err := conn.Do("DEL", redis.Args{}.AddFlat(keys)...); err != nil {
+			return err
+		}
+	}
+
+	var maxCreatedAt map[FootprintGroup]time.Time = map[FootprintGroup]time.Time{}
+
+	fps, err := storage.AllFootprints()
+	if err != nil {
+		return err
+	}
+
+	for _, fp := range fps {
+		group := FootprintGroup{
+			UserID:  fp.UserID,
+			OwnerID: fp.OwnerID,
+			Day:     footprintDay(fp.CreatedAt),
+		}
+
+		if fp.CreatedAt.After(maxCreatedAt[group]) {
+			maxCreatedAt[group] = fp.CreatedAt
+		}
+	}
+
+	if err := zaddNewer.Load(conn); err != nil {
+		return err
+	}
+	for group, createdAt := range maxCreatedAt {
+		zaddNewer.SendHash(conn, footprintKey(group.UserID), -createdAt.Unix(), footprintMember(group.OwnerID, group.Day))
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if e, ok := reply.(redis.Error); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func FetchFootprints(userId int, limit int) ([]Footprint, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("ZRANGE", footprintKey(userId), 0, limit-1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+
+	footprints := make([]Footprint, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		fp, err := parseFootprintMember(userId, values[i], score)
+		if err != nil {
+			return nil, err
+		}
+		footprints = append(footprints, fp)
+	}
+
+	return footprints, nil
+}
+
+// ===== Redis Seed End =====
+
+// cacheFootprint writes a visit through to Redis after it has been stored in MySQL.
+func cacheFootprint(userID, ownerID int, t time.Time) {
+	if atomic.LoadInt32(&footprintsCached) == 0 && atomic.LoadInt32(&footprintsRebuilding) == 0 {
+		return
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	if _, err := zaddNewer.Do(conn, footprintKey(userID), -t.Unix(), footprintMember(ownerID, footprintDay(t))); err != nil {
+		footprintCacheErrors.Add(1)
+		log.Printf("Failed to cache footprint, reading footprints from MySQL: %s", err.Error())
+		atomic.StoreInt32(&footprintsRebuilding, 0)
+		atomic.StoreInt32(&footprintsCached, 0)
+		return
+	}
+	if retention.enabled() {
+		if err := trimFootprints(conn, userID); err != nil {
+			log.Printf("Failed to trim footprints of user %d: %s", userID, err.Error())
+		}
+	}
+}
+
+// getFootprints returns the latest footprints of userID from Redis,
+// falling back to MySQL when the cache is unavailable.
+func getFootprints(userID, limit int) ([]Footprint, error) {
+	if atomic.LoadInt32(&footprintsCached) == 1 {
+		fps, err := FetchFootprints(userID, limit)
+		if err == nil {
+			return fps, nil
+		}
+		footprintCacheErrors.Add(1)
+		log.Printf("Failed to fetch footprints from cache: %s", err.Error())
+	}
+	return storage.Footprints(userID, limit)
+}
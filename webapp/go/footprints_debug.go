@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// footprintDiff compares the Redis and MySQL views of a user's footprints.
+// Footprints are matched by visitor and day.
+type footprintDiff struct {
+	UserID      int            `json:"user_id"`
+	OnlyInRedis []Footprint    `json:"only_in_redis"`
+	OnlyInMySQL []Footprint    `json:"only_in_mysql"`
+	Mismatched  [][2]Footprint `json:"mismatched"`
+}
+
+func diffFootprints(userID int, cached, stored []Footprint) footprintDiff {
+	diff := footprintDiff{
+		UserID:      userID,
+		OnlyInRedis: []Footprint{},
+		OnlyInMySQL: []Footprint{},
+		Mismatched:  [][2]Footprint{},
+	}
+	key := func(fp Footprint) string {
+		return footprintMember(fp.OwnerID, fp.CreatedAt.Format("2006-01-02"))
+	}
+
+	fromSQL := make(map[string]Footprint, len(stored))
+	for _, fp := range stored {
+		fromSQL[key(fp)] = fp
+	}
+	for _, fp := range cached {
+		sfp, ok := fromSQL[key(fp)]
+		if !ok {
+			diff.OnlyInRedis = append(diff.OnlyInRedis, fp)
+			continue
+		}
+		delete(fromSQL, key(fp))
+		if !fp.UpdatedAt.Equal(sfp.UpdatedAt) {
+			diff.Mismatched = append(diff.Mismatched, [2]Footprint{fp, sfp})
+		}
+	}
+	for _, fp := range stored {
+		if _, ok := fromSQL[key(fp)]; ok {
+			diff.OnlyInMySQL = append(diff.OnlyInMySQL, fp)
+		}
+	}
+	return diff
+}
+
+// GetFootprintsDiff is served on the debug listener only:
+// /debug/footprints?user_id=1&limit=50
+func GetFootprintsDiff(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+
+	cached, err := FetchFootprints(userID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stored, err := storage.Footprints(userID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffFootprints(userID, cached, stored))
+}
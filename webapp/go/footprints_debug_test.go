@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func footprintOn(ownerID int, day string, updated time.Time) Footprint {
+	d, _ := time.ParseInLocation("2006-01-02", day, footprintLocation)
+	return Footprint{UserID: 1, OwnerID: ownerID, CreatedAt: d, UpdatedAt: updated}
+}
+
+func TestDiffFootprints(t *testing.T) {
+	t0 := time.Date(2026, 3, 4, 12, 0, 0, 0, footprintLocation)
+	same := footprintOn(2, "2026-03-04", t0)
+	cached := []Footprint{
+		same,
+		footprintOn(3, "2026-03-04", t0),
+		footprintOn(4, "2026-03-03", t0),
+	}
+	stored := []Footprint{
+		same,
+		footprintOn(3, "2026-03-04", t0.Add(time.Minute)),
+		// Same visitor as in Redis, but another day.
+		footprintOn(4, "2026-03-02", t0),
+	}
+
+	diff := diffFootprints(1, cached, stored)
+	if diff.UserID != 1 {
+		t.Errorf("UserID = %d", diff.UserID)
+	}
+	if len(diff.Mismatched) != 1 || diff.Mismatched[0][0].OwnerID != 3 || !diff.Mismatched[0][1].UpdatedAt.Equal(t0.Add(time.Minute)) {
+		t.Errorf("Mismatched = %v, want the visits of 3", diff.Mismatched)
+	}
+	if len(diff.OnlyInRedis) != 1 || diff.OnlyInRedis[0].CreatedAt.Day() != 3 {
+		t.Errorf("OnlyInRedis = %v, want 4 on the 3rd", diff.OnlyInRedis)
+	}
+	if len(diff.OnlyInMySQL) != 1 || diff.OnlyInMySQL[0].CreatedAt.Day() != 2 {
+		t.Errorf("OnlyInMySQL = %v, want 4 on the 2nd", diff.OnlyInMySQL)
+	}
+}
+
+func TestDiffFootprintsEqual(t *testing.T) {
+	t0 := time.Date(2026, 3, 4, 12, 0, 0, 0, footprintLocation)
+	fps := []Footprint{footprintOn(2, "2026-03-04", t0), footprintOn(3, "2026-03-01", t0)}
+	diff := diffFootprints(1, fps, fps)
+	if len(diff.OnlyInRedis)+len(diff.OnlyInMySQL)+len(diff.Mismatched) != 0 {
+		t.Errorf("diff of equal lists = %+v", diff)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	redis "github.com/garyburd/redigo/redis"
+)
+
+// footprintRetention bounds how many footprints are kept.
+// A zero field disables that rule.
+//
+// Both rules work on the visitor/day groups of Store.Footprints, in MySQL
+// and in Redis alike, so the two agree after a compaction. They are
+// enforced on every visit for the visited user and by the periodic
+// compaction for everyone else.
+type footprintRetention struct {
+	// KeepPerUser is the number of newest visitor/day groups kept for each
+	// user. Groups whose latest visit ties with the last one kept stay too.
+	KeepPerUser int
+	// KeepDays drops the groups whose latest visit is older than this many days.
+	KeepDays int
+}
+
+// Pruning also deletes rows of the initial data (footprints.id <= 500000),
+// which /initialize does not restore. Leave both variables unset when the
+// data has to be reset for a benchmark.
+var retention = footprintRetention{
+	KeepPerUser: getEnvInt("ISUCON5_FOOTPRINT_KEEP", 0),
+	KeepDays:    getEnvInt("ISUCON5_FOOTPRINT_KEEP_DAYS", 0),
+}
+
+var (
+	prunedFootprintsMySQL = expvar.NewInt("footprints_pruned_mysql")
+	prunedFootprintsRedis = expvar.NewInt("footprints_pruned_redis")
+)
+
+func (p footprintRetention) enabled() bool {
+	return p.KeepPerUser > 0 || p.KeepDays > 0
+}
+
+// cutoff returns the time before which footprints are dropped, or the zero
+// time when there is no age limit.
+func (p footprintRetention) cutoff(now time.Time) time.Time {
+	if p.KeepDays <= 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, 0, -p.KeepDays)
+}
+
+// trimFootprints applies the retention policy to the sorted set of userID.
+func trimFootprints(conn redis.Conn, userID int) error {
+	key := footprintKey(userID)
+	if retention.KeepPerUser > 0 {
+		// Trim by the score of the last member kept rather than by rank,
+		// so ties are kept as in PruneUserFootprints.
+		values, err := redis.Strings(conn.Do("ZRANGE", key, retention.KeepPerUser-1, retention.KeepPerUser-1, "WITHSCORES"))
+		if err != nil {
+			return err
+		}
+		if len(values) == 2 {
+			n, err := redis.Int64(conn.Do("ZREMRANGEBYSCORE", key, "("+values[1], "+inf"))
+			if err != nil {
+				return err
+			}
+			prunedFootprintsRedis.Add(n)
+		}
+	}
+	if cutoff := retention.cutoff(time.Now()); !cutoff.IsZero() {
+		// Scores are negated, so older visits have larger scores.
+		n, err := redis.Int64(conn.Do("ZREMRANGEBYSCORE", key, "("+strconv.FormatInt(-cutoff.Unix(), 10), "+inf"))
+		if err != nil {
+			return err
+		}
+		prunedFootprintsRedis.Add(n)
+	}
+	return nil
+}
+
+// pruneFootprintsOnWrite applies the retention policy to the footprints of
+// userID in MySQL after a visit. cacheFootprint does the same in Redis.
+func pruneFootprintsOnWrite(userID int) {
+	if !retention.enabled() {
+		return
+	}
+	n, err := storage.PruneUserFootprints(userID, retention.KeepPerUser, retention.cutoff(time.Now()))
+	prunedFootprintsMySQL.Add(n)
+	if err != nil {
+		log.Printf("Failed to prune footprints of user %d: %s", userID, err.Error())
+	}
+}
+
+// compactFootprints applies the retention policy to every user, in MySQL and in Redis.
+func compactFootprints() error {
+	n, err := storage.PruneFootprints(retention.KeepPerUser, retention.cutoff(time.Now()))
+	if err != nil {
+		return err
+	}
+	prunedFootprintsMySQL.Add(n)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "footprints:user_id:*", "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			var userID int
+			if _, err := fmt.Sscanf(key, "footprints:user_id:%d", &userID); err != nil {
+				continue
+			}
+			if err := trimFootprints(conn, userID); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// startFootprintCompaction runs compactFootprints every interval.
+func startFootprintCompaction(interval time.Duration) {
+	if !retention.enabled() {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := compactFootprints(); err != nil {
+				log.Printf("Failed to compact footprints: %s", err.Error())
+			}
+		}
+	}()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFootprintMember(t *testing.T) {
+	visited := time.Date(2026, 3, 4, 15, 4, 5, 0, footprintLocation)
+	member := footprintMember(42, footprintDay(visited))
+
+	fp, err := parseFootprintMember(7, member, float64(-visited.Unix()))
+	if err != nil {
+		t.Fatalf("parseFootprintMember(%q): %v", member, err)
+	}
+	if fp.UserID != 7 || fp.OwnerID != 42 {
+		t.Errorf("got user %d, owner %d, want 7 and 42", fp.UserID, fp.OwnerID)
+	}
+	if want := time.Date(2026, 3, 4, 0, 0, 0, 0, footprintLocation); !fp.CreatedAt.Equal(want) {
+		t.Errorf("CreatedAt = %v, want the day %v", fp.CreatedAt, want)
+	}
+	if !fp.UpdatedAt.Equal(visited) {
+		t.Errorf("UpdatedAt = %v, want %v", fp.UpdatedAt, visited)
+	}
+}
+
+func TestParseFootprintMemberRejectsMalformed(t *testing.T) {
+	for _, member := range []string{"", "42", "x:2026-03-04", "42:2026/03/04", "42:"} {
+		if _, err := parseFootprintMember(7, member, 0); err == nil {
+			t.Errorf("parseFootprintMember(%q) succeeded", member)
+		}
+	}
+}
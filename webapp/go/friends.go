@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// friendGraph is an in-memory copy of the relations table.
+// Relations are symmetric, so every edge is stored in both directions.
+type friendGraph struct {
+	mu    sync.RWMutex
+	edges map[int]map[int]time.Time
+}
+
+var friendships = newFriendGraph()
+
+func newFriendGraph() *friendGraph {
+	return &friendGraph{edges: map[int]map[int]time.Time{}}
+}
+
+// Load replaces the whole graph with rels.
+func (g *friendGraph) Load(rels []Relation) {
+	edges := map[int]map[int]time.Time{}
+	for _, rel := range rels {
+		addEdge(edges, rel.One, rel.Another, rel.CreatedAt)
+		addEdge(edges, rel.Another, rel.One, rel.CreatedAt)
+	}
+
+	g.mu.Lock()
+	g.edges = edges
+	g.mu.Unlock()
+}
+
+func addEdge(edges map[int]map[int]time.Time, from, to int, createdAt time.Time) {
+	friends, ok := edges[from]
+	if !ok {
+		friends = map[int]time.Time{}
+		edges[from] = friends
+	}
+	if createdAt.After(friends[to]) {
+		friends[to] = createdAt
+	}
+}
+
+func (g *friendGraph) Add(one, another int, createdAt time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	addEdge(g.edges, one, another, createdAt)
+	addEdge(g.edges, another, one, createdAt)
+}
+
+func (g *friendGraph) IsFriend(one, another int) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	_, ok := g.edges[one][another]
+	return ok
+}
+
+// FriendsOf returns the friends of userID, most recent relation first.
+func (g *friendGraph) FriendsOf(userID int) []Friend {
+	g.mu.RLock()
+	friends := make([]Friend, 0, len(g.edges[userID]))
+	for id, createdAt := range g.edges[userID] {
+		friends = append(friends, Friend{id, createdAt})
+	}
+	g.mu.RUnlock()
+
+	sort.Slice(friends, func(i, j int) bool {
+		if friends[i].CreatedAt.Equal(friends[j].CreatedAt) {
+			return friends[i].ID < friends[j].ID
+		}
+		return friends[i].CreatedAt.After(friends[j].CreatedAt)
+	})
+	return friends
+}
+
+func (g *friendGraph) FriendCount(userID int) int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.edges[userID])
+}
+
+// Adjacency returns a copy of the friend ids of every user.
+func (g *friendGraph) Adjacency() map[int][]int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	adjacency := make(map[int][]int, len(g.edges))
+	for userID, friends := range g.edges {
+		ids := make([]int, 0, len(friends))
+		for id := range friends {
+			ids = append(ids, id)
+		}
+		adjacency[userID] = ids
+	}
+	return adjacency
+}
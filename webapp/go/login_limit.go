@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	redis "github.com/garyburd/redigo/redis"
+)
+
+// loginLockedError replaces ErrAuthentication while logins from an address
+// or to an account are throttled.
+type loginLockedError struct {
+	until time.Time
+}
+
+func (e *loginLockedError) Error() string {
+	return "Too many login attempts."
+}
+
+// attemptStore keeps the failed logins of a key (an address or an email)
+// and the lockouts.
+type attemptStore interface {
+	// Fail records a failure and returns the failures within window.
+	Fail(key string, now time.Time, window time.Duration) (int, error)
+	Failures(key string, now time.Time, window time.Duration) (int, error)
+	Reset(key string) error
+	Lock(key string, until time.Time) error
+	// LockedUntil returns the zero time when key is not locked.
+	LockedUntil(key string, now time.Time) (time.Time, error)
+}
+
+// loginLimiter allows MaxPerIP failures per address and MaxPerEmail
+// failures per account within Window. An account that reaches its limit is
+// also locked for Lockout, which may outlast the window. A zero limit or
+// Lockout disables that rule.
+type loginLimiter struct {
+	Window      time.Duration
+	MaxPerIP    int
+	MaxPerEmail int
+	Lockout     time.Duration
+
+	store attemptStore
+}
+
+var logins = newLoginLimiter(newMemoryAttempts())
+
+// trustProxyHeader makes clientIP read X-Real-IP, which nginx sets in front of the app.
+var trustProxyHeader = os.Getenv("ISUCON5_TRUST_PROXY") == "1"
+
+func newLoginLimiter(store attemptStore) *loginLimiter {
+	return &loginLimiter{
+		Window:      time.Duration(getEnvInt("ISUCON5_LOGIN_WINDOW", 300)) * time.Second,
+		MaxPerIP:    getEnvInt("ISUCON5_LOGIN_MAX_PER_IP", 50),
+		MaxPerEmail: getEnvInt("ISUCON5_LOGIN_MAX_PER_EMAIL", 5),
+		Lockout:     time.Duration(getEnvInt("ISUCON5_LOGIN_LOCKOUT", 900)) * time.Second,
+		store:       store,
+	}
+}
+
+func clientIP(r *http.Request) string {
+	if trustProxyHeader {
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ipKey(ip string) string       { return "ip:" + ip }
+func emailKey(email string) string { return "email:" + email }
+
+// Allow returns a *loginLockedError when ip or email may not try again yet.
+func (l *loginLimiter) Allow(ip, email string) error {
+	t := time.Now()
+	if l.MaxPerIP > 0 {
+		n, err := l.store.Failures(ipKey(ip), t, l.Window)
+		if err != nil {
+			return err
+		}
+		if n >= l.MaxPerIP {
+			return &loginLockedError{until: t.Add(l.Window)}
+		}
+	}
+	if l.MaxPerEmail > 0 {
+		until, err := l.store.LockedUntil(emailKey(email), t)
+		if err != nil {
+			return err
+		}
+		if !until.IsZero() {
+			return &loginLockedError{until: until}
+		}
+		n, err := l.store.Failures(emailKey(email), t, l.Window)
+		if err != nil {
+			return err
+		}
+		if n >= l.MaxPerEmail {
+			return &loginLockedError{until: t.Add(l.Window)}
+		}
+	}
+	return nil
+}
+
+// Fail records a failed login and locks the account once it reaches
+// MaxPerEmail. Unknown emails only count against the address, so a client
+// can't fill the store with made up ones.
+func (l *loginLimiter) Fail(ip, email string) error {
+	t := time.Now()
+	if l.MaxPerIP > 0 {
+		if _, err := l.store.Fail(ipKey(ip), t, l.Window); err != nil {
+			return err
+		}
+	}
+	if _, known := users.ByEmail(email); known && l.MaxPerEmail > 0 {
+		n, err := l.store.Fail(emailKey(email), t, l.Window)
+		if err != nil {
+			return err
+		}
+		if n >= l.MaxPerEmail && l.Lockout > 0 {
+			log.Printf("Locking logins to %s after %d failures", email, n)
+			return l.store.Lock(emailKey(email), t.Add(l.Lockout))
+		}
+	}
+	return nil
+}
+
+// Succeed forgets the failures of the account. Those of the address are
+// kept, as one address may be trying many accounts.
+func (l *loginLimiter) Succeed(email string) error {
+	return l.store.Reset(emailKey(email))
+}
+
+// memoryAttempts keeps the attempts of this process. Keys are dropped when
+// read after they expire, and by a sweep of all keys at most once a window.
+type memoryAttempts struct {
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	locks     map[string]time.Time
+	lastSweep time.Time
+}
+
+func newMemoryAttempts() *memoryAttempts {
+	return &memoryAttempts{
+		failures: map[string][]time.Time{},
+		locks:    map[string]time.Time{},
+	}
+}
+
+// recent drops the failures of key that left the window. Must hold mu.
+func (m *memoryAttempts) recent(key string, now time.Time, window time.Duration) []time.Time {
+	ts := m.failures[key]
+	i := 0
+	for i < len(ts) && !ts[i].After(now.Add(-window)) {
+		i++
+	}
+	ts = ts[i:]
+	if len(ts) == 0 {
+		delete(m.failures, key)
+	} else {
+		m.failures[key] = ts
+	}
+	return ts
+}
+
+// sweep drops every expired failure and lock. Must hold mu.
+func (m *memoryAttempts) sweep(now time.Time, window time.Duration) {
+	if now.Sub(m.lastSweep) < window {
+		return
+	}
+	m.lastSweep = now
+	for key := range m.failures {
+		m.recent(key, now, window)
+	}
+	for key, until := range m.locks {
+		if !until.After(now) {
+			delete(m.locks, key)
+		}
+	}
+}
+
+func (m *memoryAttempts) Fail(key string, now time.Time, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(now, window)
+	ts := append(m.recent(key, now, window), now)
+	m.failures[key] = ts
+	return len(ts), nil
+}
+
+func (m *memoryAttempts) Failures(key string, now time.Time, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.recent(key, now, window)), nil
+}
+
+func (m *memoryAttempts) Reset(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failures, key)
+	return nil
+}
+
+func (m *memoryAttempts) Lock(key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.locks[key] = until
+	return nil
+}
+
+func (m *memoryAttempts) LockedUntil(key string, now time.Time) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	until, ok := m.locks[key]
+	if !ok {
+		return time.Time{}, nil
+	}
+	if !until.After(now) {
+		delete(m.locks, key)
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// redisAttempts shares the counts between app servers. The failures of a
+// key are a sorted set scored by time in nanoseconds.
+type redisAttempts struct {
+	seq int64
+}
+
+func loginFailuresKey(key string) string { return "login_failures:" + key }
+func loginLockKey(key string) string     { return "login_lock:" + key }
+
+func (a *redisAttempts) Fail(key string, now time.Time, window time.Duration) (int, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	k := loginFailuresKey(key)
+	member := fmt.Sprintf("%d-%d", now.UnixNano(), atomic.AddInt64(&a.seq, 1))
+	conn.Send("MULTI")
+	conn.Send("ZREMRANGEBYSCORE", k, "-inf", now.Add(-window).UnixNano())
+	conn.Send("ZADD", k, now.UnixNano(), member)
+	conn.Send("ZCARD", k)
+	conn.Send("PEXPIRE", k, int64(window/time.Millisecond))
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(replies[2], nil)
+}
+
+func (a *redisAttempts) Failures(key string, now time.Time, window time.Duration) (int, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+	return redis.Int(conn.Do("ZCOUNT", loginFailuresKey(key), fmt.Sprintf("(%d", now.Add(-window).UnixNano()), "+inf"))
+}
+
+func (a *redisAttempts) Reset(key string) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", loginFailuresKey(key))
+	return err
+}
+
+func (a *redisAttempts) Lock(key string, until time.Time) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+	ttl := int64(time.Until(until) / time.Millisecond)
+	if ttl <= 0 {
+		return nil
+	}
+	_, err := conn.Do("SET", loginLockKey(key), until.Unix(), "PX", ttl)
+	return err
+}
+
+func (a *redisAttempts) LockedUntil(key string, now time.Time) (time.Time, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+	sec, err := redis.Int64(conn.Do("GET", loginLockKey(key)))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
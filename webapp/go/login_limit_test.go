@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestLimiter() (*loginLimiter, *memoryAttempts) {
+	users = newUserDirectory()
+	users.Add(User{ID: 1, AccountName: "alice", Email: "alice@example.com"}, "")
+	attempts := newMemoryAttempts()
+	l := newLoginLimiter(attempts)
+	l.Window = time.Minute
+	l.MaxPerIP = 10
+	l.MaxPerEmail = 3
+	l.Lockout = time.Hour
+	return l, attempts
+}
+
+func TestLoginLimiterLocksAccount(t *testing.T) {
+	l, _ := newTestLimiter()
+	for i := 0; i < l.MaxPerEmail; i++ {
+		if err := l.Allow("192.0.2.1", "alice@example.com"); err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+		l.Fail("192.0.2.1", "alice@example.com")
+	}
+
+	err := l.Allow("192.0.2.2", "alice@example.com")
+	locked, ok := err.(*loginLockedError)
+	if !ok {
+		t.Fatalf("Allow after %d failures = %v, want a lockout", l.MaxPerEmail, err)
+	}
+	if left := time.Until(locked.until); left < l.Lockout-time.Minute || left > l.Lockout {
+		t.Errorf("locked for %v, want about %v", left, l.Lockout)
+	}
+	if err := l.Allow("192.0.2.1", "bob@example.com"); err != nil {
+		t.Errorf("other account: %v", err)
+	}
+}
+
+func TestLoginLimiterSucceedForgetsFailures(t *testing.T) {
+	l, _ := newTestLimiter()
+	for i := 0; i < l.MaxPerEmail-1; i++ {
+		l.Fail("192.0.2.1", "alice@example.com")
+	}
+	l.Succeed("alice@example.com")
+	l.Fail("192.0.2.1", "alice@example.com")
+	if err := l.Allow("192.0.2.1", "alice@example.com"); err != nil {
+		t.Errorf("Allow = %v, want the failures before the success forgotten", err)
+	}
+}
+
+func TestLoginLimiterThrottlesAddress(t *testing.T) {
+	l, _ := newTestLimiter()
+	for i := 0; i < l.MaxPerIP; i++ {
+		l.Fail("192.0.2.1", "user"+strconv.Itoa(i)+"@example.com")
+	}
+	if _, ok := l.Allow("192.0.2.1", "alice@example.com").(*loginLockedError); !ok {
+		t.Error("address was not throttled")
+	}
+	if err := l.Allow("192.0.2.2", "alice@example.com"); err != nil {
+		t.Errorf("other address: %v", err)
+	}
+}
+
+func TestLoginLimiterIgnoresUnknownEmails(t *testing.T) {
+	l, attempts := newTestLimiter()
+	l.MaxPerIP = 0
+	for i := 0; i < l.MaxPerEmail; i++ {
+		l.Fail("192.0.2.1", "nobody@example.com")
+	}
+	if err := l.Allow("192.0.2.1", "nobody@example.com"); err != nil {
+		t.Errorf("unknown email was locked: %v", err)
+	}
+	if len(attempts.failures) != 0 || len(attempts.locks) != 0 {
+		t.Errorf("unknown email was tracked: %v %v", attempts.failures, attempts.locks)
+	}
+}
+
+func TestMemoryAttemptsWindow(t *testing.T) {
+	m := newMemoryAttempts()
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	window := 5 * time.Minute
+
+	m.Fail("k", t0, window)
+	if n, _ := m.Fail("k", t0.Add(time.Minute), window); n != 2 {
+		t.Errorf("failures = %d, want 2", n)
+	}
+	if n, _ := m.Failures("k", t0.Add(window), window); n != 1 {
+		t.Errorf("failures once the first left the window = %d, want 1", n)
+	}
+	if n, _ := m.Failures("k", t0.Add(window+time.Minute), window); n != 0 {
+		t.Errorf("failures after the window = %d, want 0", n)
+	}
+	if _, ok := m.failures["k"]; ok {
+		t.Error("expired key was kept")
+	}
+}
+
+func TestMemoryAttemptsLock(t *testing.T) {
+	m := newMemoryAttempts()
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.Lock("k", t0.Add(time.Minute))
+	if until, _ := m.LockedUntil("k", t0); !until.Equal(t0.Add(time.Minute)) {
+		t.Errorf("LockedUntil = %v", until)
+	}
+	if until, _ := m.LockedUntil("k", t0.Add(time.Minute)); !until.IsZero() {
+		t.Errorf("LockedUntil after the lock = %v, want zero", until)
+	}
+}
+
+func TestMemoryAttemptsSweep(t *testing.T) {
+	m := newMemoryAttempts()
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	window := time.Minute
+	for i := 0; i < 1000; i++ {
+		m.Fail("ip:"+strconv.Itoa(i), t0, window)
+		m.Lock("email:"+strconv.Itoa(i), t0.Add(window))
+	}
+
+	m.Fail("ip:new", t0.Add(2*window), window)
+	if len(m.failures) != 1 || len(m.locks) != 0 {
+		t.Errorf("after a sweep: %d failure keys, %d locks, want 1 and 0", len(m.failures), len(m.locks))
+	}
+}
+
+func TestLoginLimiterWindowWithoutLockout(t *testing.T) {
+	l, _ := newTestLimiter()
+	l.Lockout = 0
+	for i := 0; i < l.MaxPerEmail; i++ {
+		l.Fail("192.0.2.1", "alice@example.com")
+	}
+	if _, ok := l.Allow("192.0.2.2", "alice@example.com").(*loginLockedError); !ok {
+		t.Error("account was not throttled within the window")
+	}
+}
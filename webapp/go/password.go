@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordHasher is one scheme of users.passhash.
+type passwordHasher interface {
+	Name() string
+	// Owns reports whether a stored hash was made by this scheme.
+	Owns(hash string) bool
+	Hash(passwd string) (string, error)
+	Verify(passwd, hash, salt string) bool
+}
+
+// legacyHasher is the hex sha512(passwd + salt) of the initial data, with
+// the salt kept in the salts table.
+type legacyHasher struct{}
+
+func (legacyHasher) Name() string { return "sha512" }
+
+func (legacyHasher) Owns(hash string) bool {
+	return len(hash) == 2*sha512.Size && !strings.HasPrefix(hash, "$")
+}
+
+func (legacyHasher) Hash(passwd string) (string, error) {
+	return "", fmt.Errorf("sha512 is only kept to verify old passwords")
+}
+
+func (legacyHasher) Verify(passwd, hash, salt string) bool {
+	sum := fmt.Sprintf("%x", sha512.Sum512([]byte(passwd+salt)))
+	return subtle.ConstantTimeCompare([]byte(sum), []byte(hash)) == 1
+}
+
+// bcryptHasher embeds its own salt, so the salts table is not used.
+type bcryptHasher struct {
+	cost int
+}
+
+func (bcryptHasher) Name() string { return "bcrypt" }
+
+func (bcryptHasher) Owns(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (h bcryptHasher) Hash(passwd string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(passwd), h.cost)
+	return string(b), err
+}
+
+func (bcryptHasher) Verify(passwd, hash, salt string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(passwd)) == nil
+}
+
+var (
+	// currentHasher hashes every new password. Users on another scheme
+	// are rehashed with it the next time they log in.
+	currentHasher passwordHasher = bcryptHasher{cost: getEnvInt("ISUCON5_BCRYPT_COST", bcrypt.DefaultCost)}
+	// passwordHashers are the schemes accepted when verifying a password.
+	passwordHashers = []passwordHasher{currentHasher, legacyHasher{}}
+)
+
+func init() {
+	expvar.Publish("password_schemes", expvar.Func(passwordSchemeReport))
+}
+
+func hasherFor(hash string) passwordHasher {
+	for _, h := range passwordHashers {
+		if h.Owns(hash) {
+			return h
+		}
+	}
+	return nil
+}
+
+// checkPassword verifies passwd for user and moves the user to
+// currentHasher if it was stored with an older scheme.
+func checkPassword(user User, passwd string) bool {
+	salt, _ := users.Salt(user.ID)
+	h := hasherFor(user.PassHash)
+	if h == nil || !h.Verify(passwd, user.PassHash, salt) {
+		return false
+	}
+	if h.Name() != currentHasher.Name() {
+		if err := upgradePassword(user.ID, passwd); err != nil {
+			log.Printf("Failed to rehash the password of user %d: %s", user.ID, err.Error())
+		}
+	}
+	return true
+}
+
+func upgradePassword(userID int, passwd string) error {
+	hash, err := currentHasher.Hash(passwd)
+	if err != nil {
+		return err
+	}
+	if err := storage.UpdatePassHash(userID, hash); err != nil {
+		return err
+	}
+	users.Update(userID, func(u *User) { u.PassHash = hash })
+	return nil
+}
+
+// passwordSchemeReport counts the users of each scheme, so we can tell
+// how many accounts are still on sha512.
+func passwordSchemeReport() interface{} {
+	counts := map[string]int{}
+	users.Each(func(u User) {
+		name := "unknown"
+		if h := hasherFor(u.PassHash); h != nil {
+			name = h.Name()
+		}
+		counts[name]++
+	})
+	return counts
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	redis "github.com/garyburd/redigo/redis"
+)
+
+// redisPool is shared by every Redis-backed feature. redigo connections are
+// not safe for concurrent use, so always Get a connection and Close it when done.
+var redisPool *redis.Pool
+
+// redisHealthCheckAfter is how long a connection may sit idle in the pool
+// before it is PINGed on borrow.
+const redisHealthCheckAfter = 10 * time.Second
+
+// newRedisPool dials with connectTimeout and gives up on a command after
+// ioTimeout, so a stalled Redis fails requests over to MySQL instead of
+// blocking them and, through Wait, every request after them.
+func newRedisPool(network, address string, maxIdle, maxActive int, connectTimeout, ioTimeout time.Duration) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     maxIdle,
+		MaxActive:   maxActive,
+		IdleTimeout: 240 * time.Second,
+		Wait:        true,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial(network, address,
+				redis.DialConnectTimeout(connectTimeout),
+				redis.DialReadTimeout(ioTimeout),
+				redis.DialWriteTimeout(ioTimeout))
+		},
+		// A failed check makes the pool discard the connection and dial a new one.
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < redisHealthCheckAfter {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+func pingRedis() error {
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+func getEnvInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
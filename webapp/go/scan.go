@@ -0,0 +1,66 @@
+package main
+
+import "strings"
+
+// Column lists used by the MySQL store. Queries name their columns instead
+// of using SELECT *, so a schema change such as the title column added by
+// alterdb.sql doesn't shift the scan order. Keep each list in sync with
+// its scan function below.
+const (
+	userColumns    = "id, account_name, nick_name, email, passhash"
+	profileColumns = "user_id, first_name, last_name, sex, birthday, pref, updated_at"
+	entryColumns   = "id, user_id, private, title, body, created_at, updated_at"
+	commentColumns = "id, entry_id, user_id, comment, created_at"
+	// footprintColumns selects one visitor per day with the time of the
+	// latest visit, to be used with GROUP BY user_id, owner_id, DATE(created_at).
+	footprintColumns = "user_id, owner_id, DATE(created_at) AS date, MAX(created_at) AS updated"
+)
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// qualify prefixes every column of columns with the table alias.
+func qualify(alias, columns string) string {
+	cols := strings.Split(columns, ", ")
+	for i, col := range cols {
+		cols[i] = alias + "." + col
+	}
+	return strings.Join(cols, ", ")
+}
+
+func scanUser(rs rowScanner, extra ...interface{}) (User, error) {
+	u := User{}
+	dest := append([]interface{}{&u.ID, &u.AccountName, &u.NickName, &u.Email, &u.PassHash}, extra...)
+	err := rs.Scan(dest...)
+	return u, err
+}
+
+func scanProfile(rs rowScanner) (Profile, error) {
+	p := Profile{}
+	err := rs.Scan(&p.UserID, &p.FirstName, &p.LastName, &p.Sex, &p.Birthday, &p.Pref, &p.UpdatedAt)
+	return p, err
+}
+
+func scanEntry(rs rowScanner) (Entry, error) {
+	e := Entry{}
+	var private int
+	err := rs.Scan(&e.ID, &e.UserID, &private, &e.Title, &e.Content, &e.CreatedAt, &e.UpdatedAt)
+	e.Private = private == 1
+	return e, err
+}
+
+// scanComment scans commentColumns followed by any extra columns of the query.
+func scanComment(rs rowScanner, extra ...interface{}) (Comment, error) {
+	c := Comment{}
+	dest := append([]interface{}{&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt}, extra...)
+	err := rs.Scan(dest...)
+	return c, err
+}
+
+func scanFootprint(rs rowScanner) (Footprint, error) {
+	fp := Footprint{}
+	err := rs.Scan(&fp.UserID, &fp.OwnerID, &fp.CreatedAt, &fp.UpdatedAt)
+	return fp, err
+}
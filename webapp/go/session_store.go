@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "github.com/garyburd/redigo/redis"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// sessionKeyPairs turns ISUCON5_SESSION_SECRET into the key pairs of
+// securecookie. The secret may list several comma separated keys: cookies
+// are signed with the first one and accepted with any of them, so a new
+// key can be put first while the old one is still in use.
+func sessionKeyPairs(secret string) [][]byte {
+	pairs := [][]byte{}
+	for _, key := range strings.Split(secret, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			pairs = append(pairs, []byte(key), nil)
+		}
+	}
+	return pairs
+}
+
+var errSessionNotFound = errors.New("session not found")
+
+// sessionRecord is what a server side session keeps. The cookie only
+// carries the signed session id.
+type sessionRecord struct {
+	UserID    int
+	Values    map[interface{}]interface{}
+	CreatedAt time.Time
+	LastSeen  time.Time
+}
+
+func (rec sessionRecord) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(rec)
+	return buf.Bytes(), err
+}
+
+func decodeSessionRecord(b []byte) (sessionRecord, error) {
+	rec := sessionRecord{}
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&rec)
+	return rec, err
+}
+
+// sessionBackend stores the records of serverStore.
+type sessionBackend interface {
+	// Load returns errSessionNotFound for unknown or expired ids.
+	Load(id string) (sessionRecord, error)
+	Save(id string, rec sessionRecord, ttl time.Duration) error
+	Delete(id string) error
+	// DeleteUser drops every session of userID, logging it out everywhere.
+	DeleteUser(userID int) error
+}
+
+// sessionSweeper is implemented by backends that don't drop expired
+// records by themselves.
+type sessionSweeper interface {
+	DeleteExpired(now time.Time) (int64, error)
+}
+
+var sweptSessions = expvar.NewInt("sessions_swept")
+
+// startSessionSweep deletes the expired sessions of st every interval.
+// Every visit to /login saves a session for its CSRF token, so without it
+// the table would grow with each anonymous visitor.
+func startSessionSweep(st *serverStore, interval time.Duration) {
+	sweeper, ok := st.backend.(sessionSweeper)
+	if !ok {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			n, err := sweeper.DeleteExpired(time.Now())
+			if err != nil {
+				log.Printf("Failed to delete expired sessions: %s", err.Error())
+				continue
+			}
+			sweptSessions.Add(n)
+		}
+	}()
+}
+
+var (
+	sessionIdleTimeout = time.Duration(getEnvInt("ISUCON5_SESSION_IDLE", 3600)) * time.Second
+	sessionMaxAge      = time.Duration(getEnvInt("ISUCON5_SESSION_MAX_AGE", 7*86400)) * time.Second
+)
+
+// sessionTouchInterval limits how often a session is written back only to
+// move its idle deadline.
+const sessionTouchInterval = time.Minute
+
+// serverStore is a sessions.Store keeping the session data in a backend.
+// A session ends after IdleTimeout without requests or MaxAge after it
+// was created, whichever comes first.
+type serverStore struct {
+	Options     *sessions.Options
+	IdleTimeout time.Duration
+	MaxAge      time.Duration
+
+	backend sessionBackend
+	codecs  []securecookie.Codec
+}
+
+func newServerStore(backend sessionBackend, keyPairs ...[]byte) *serverStore {
+	return &serverStore{
+		Options:     &sessions.Options{Path: "/", MaxAge: int(sessionMaxAge / time.Second), HttpOnly: true},
+		IdleTimeout: sessionIdleTimeout,
+		MaxAge:      sessionMaxAge,
+		backend:     backend,
+		codecs:      securecookie.CodecsFromPairs(keyPairs...),
+	}
+}
+
+func (st *serverStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(st, name)
+}
+
+func (st *serverStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(st, name)
+	opts := *st.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, c.Value, &id, st.codecs...); err != nil {
+		return session, nil
+	}
+	rec, err := st.backend.Load(id)
+	if err == errSessionNotFound {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+
+	t := time.Now()
+	if t.Sub(rec.LastSeen) > st.IdleTimeout || t.Sub(rec.CreatedAt) > st.MaxAge {
+		return session, st.backend.Delete(id)
+	}
+	if t.Sub(rec.LastSeen) > sessionTouchInterval {
+		rec.LastSeen = t
+		if err := st.backend.Save(id, rec, st.ttl(rec, t)); err != nil {
+			return session, err
+		}
+	}
+
+	session.ID = id
+	session.Values = rec.Values
+	session.IsNew = false
+	return session, nil
+}
+
+// ttl is how long the backend must keep rec.
+func (st *serverStore) ttl(rec sessionRecord, t time.Time) time.Duration {
+	ttl := st.IdleTimeout
+	if left := rec.CreatedAt.Add(st.MaxAge).Sub(t); left < ttl {
+		ttl = left
+	}
+	return ttl
+}
+
+// sessionCreatedAt keeps the creation time of a session in its values,
+// since gorilla's Session has no field for it.
+const sessionCreatedAt = "_created_at"
+
+func (st *serverStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := st.backend.Delete(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	t := time.Now()
+	if session.ID == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+		session.Values[sessionCreatedAt] = t.Unix()
+	}
+	created, _ := session.Values[sessionCreatedAt].(int64)
+	userID, _ := session.Values["user_id"].(int)
+	rec := sessionRecord{UserID: userID, Values: session.Values, CreatedAt: time.Unix(created, 0), LastSeen: t}
+	if err := st.backend.Save(session.ID, rec, st.ttl(rec, t)); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, st.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew moves session to a new id, so an id seen before login can't be
+// used after it.
+func (st *serverStore) Renew(session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	if err := st.backend.Delete(session.ID); err != nil {
+		return err
+	}
+	session.ID = ""
+	delete(session.Values, sessionCreatedAt)
+	return nil
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// redisSessions keeps each session under session:<id> and the ids of a
+// user in the set user_sessions:<user_id>. No session outlives the idle
+// timeout from its last save, so neither does the set.
+type redisSessions struct{}
+
+func sessionKey(id string) string       { return "session:" + id }
+func userSessionsKey(userID int) string { return "user_sessions:" + strconv.Itoa(userID) }
+
+func (redisSessions) Load(id string) (sessionRecord, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+	b, err := redis.Bytes(conn.Do("GET", sessionKey(id)))
+	if err == redis.ErrNil {
+		return sessionRecord{}, errSessionNotFound
+	}
+	if err != nil {
+		return sessionRecord{}, err
+	}
+	return decodeSessionRecord(b)
+}
+
+func (redisSessions) Save(id string, rec sessionRecord, ttl time.Duration) error {
+	b, err := rec.encode()
+	if err != nil {
+		return err
+	}
+	conn := redisPool.Get()
+	defer conn.Close()
+	ms := int64(ttl / time.Millisecond)
+	if ms <= 0 {
+		_, err := conn.Do("DEL", sessionKey(id))
+		return err
+	}
+	conn.Send("MULTI")
+	conn.Send("SET", sessionKey(id), b, "PX", ms)
+	if rec.UserID != 0 {
+		conn.Send("SADD", userSessionsKey(rec.UserID), id)
+		conn.Send("PEXPIRE", userSessionsKey(rec.UserID), int64(sessionIdleTimeout/time.Millisecond))
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (redisSessions) Delete(id string) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", sessionKey(id))
+	return err
+}
+
+func (redisSessions) DeleteUser(userID int) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("SMEMBERS", userSessionsKey(userID)))
+	if err != nil {
+		return err
+	}
+	keys := []interface{}{userSessionsKey(userID)}
+	for _, id := range ids {
+		keys = append(keys, sessionKey(id))
+	}
+	_, err = conn.Do("DEL", keys...)
+	return err
+}
+
+// sqlSessions keeps the sessions in the sessions table of alterdb.sql.
+type sqlSessions struct {
+	db *sql.DB
+}
+
+func (s sqlSessions) Load(id string) (sessionRecord, error) {
+	var b []byte
+	err := s.db.QueryRow(`SELECT data FROM sessions WHERE id = ? AND expires_at > ?`, id, time.Now()).Scan(&b)
+	if err == sql.ErrNoRows {
+		return sessionRecord{}, errSessionNotFound
+	}
+	if err != nil {
+		return sessionRecord{}, err
+	}
+	return decodeSessionRecord(b)
+}
+
+func (s sqlSessions) Save(id string, rec sessionRecord, ttl time.Duration) error {
+	b, err := rec.encode()
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO sessions (id, user_id, data, expires_at) VALUES (?,?,?,?)
+ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), data = VALUES(data), expires_at = VALUES(expires_at)`,
+		id, rec.UserID, b, time.Now().Add(ttl))
+	return err
+}
+
+func (s sqlSessions) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+func (s sqlSessions) DeleteUser(userID int) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	return err
+}
+
+func (s sqlSessions) DeleteExpired(now time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at < ?`, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// memorySessions is a sessionBackend for tests. It keeps records until
+// they are deleted, so expiry is left to serverStore and DeleteExpired.
+type memorySessions struct {
+	mu      sync.Mutex
+	records map[string]sessionRecord
+	expires map[string]time.Time
+	swept   chan time.Time
+}
+
+func newMemorySessions() *memorySessions {
+	return &memorySessions{
+		records: map[string]sessionRecord{},
+		expires: map[string]time.Time{},
+		swept:   make(chan time.Time, 1),
+	}
+}
+
+func (m *memorySessions) Load(id string) (sessionRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.records[id]
+	if !ok {
+		return sessionRecord{}, errSessionNotFound
+	}
+	return rec, nil
+}
+
+func (m *memorySessions) Save(id string, rec sessionRecord, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records[id] = rec
+	m.expires[id] = time.Now().Add(ttl)
+	return nil
+}
+
+func (m *memorySessions) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, id)
+	delete(m.expires, id)
+	return nil
+}
+
+func (m *memorySessions) DeleteUser(userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, rec := range m.records {
+		if rec.UserID == userID {
+			delete(m.records, id)
+			delete(m.expires, id)
+		}
+	}
+	return nil
+}
+
+func (m *memorySessions) DeleteExpired(now time.Time) (int64, error) {
+	m.mu.Lock()
+	var n int64
+	for id, t := range m.expires {
+		if t.Before(now) {
+			delete(m.records, id)
+			delete(m.expires, id)
+			n++
+		}
+	}
+	m.mu.Unlock()
+	select {
+	case m.swept <- now:
+	default:
+	}
+	return n, nil
+}
+
+// edit changes the stored record of id, e.g. to move it back in time.
+func (m *memorySessions) edit(id string, fn func(rec *sessionRecord)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec := m.records[id]
+	fn(&rec)
+	m.records[id] = rec
+}
+
+func (m *memorySessions) has(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.records[id]
+	return ok
+}
+
+func newTestServerStore() (*serverStore, *memorySessions) {
+	backend := newMemorySessions()
+	st := newServerStore(backend, []byte("test-secret"), nil)
+	st.IdleTimeout = time.Hour
+	st.MaxAge = 24 * time.Hour
+	return st, backend
+}
+
+// saveSession saves session and returns a request carrying its cookie.
+func saveSession(t *testing.T, st *serverStore, session *sessions.Session) *http.Request {
+	w := httptest.NewRecorder()
+	if err := st.Save(httptest.NewRequest("GET", "/", nil), w, session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func loggedInSession(t *testing.T, st *serverStore) (*sessions.Session, *http.Request) {
+	session, err := st.New(httptest.NewRequest("GET", "/", nil), "isucon5q-go.session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["user_id"] = 42
+	return session, saveSession(t, st, session)
+}
+
+func TestServerStoreLoadsSavedSession(t *testing.T) {
+	st, _ := newTestServerStore()
+	saved, r := loggedInSession(t, st)
+
+	session, err := st.New(r, "isucon5q-go.session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if session.IsNew || session.ID != saved.ID {
+		t.Fatalf("got session %q (new=%v), want %q", session.ID, session.IsNew, saved.ID)
+	}
+	if session.Values["user_id"] != 42 {
+		t.Errorf("user_id = %v, want 42", session.Values["user_id"])
+	}
+}
+
+func TestServerStoreIdleTimeout(t *testing.T) {
+	st, backend := newTestServerStore()
+	saved, r := loggedInSession(t, st)
+	backend.edit(saved.ID, func(rec *sessionRecord) {
+		rec.LastSeen = time.Now().Add(-st.IdleTimeout - time.Minute)
+	})
+
+	session, err := st.New(r, "isucon5q-go.session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !session.IsNew || session.Values["user_id"] != nil {
+		t.Errorf("idle session was loaded: %v", session.Values)
+	}
+	if backend.has(saved.ID) {
+		t.Error("idle session was not deleted")
+	}
+}
+
+func TestServerStoreMaxAge(t *testing.T) {
+	st, backend := newTestServerStore()
+	saved, r := loggedInSession(t, st)
+	// Recently used, but created before MaxAge.
+	backend.edit(saved.ID, func(rec *sessionRecord) {
+		rec.CreatedAt = time.Now().Add(-st.MaxAge - time.Minute)
+	})
+
+	session, err := st.New(r, "isucon5q-go.session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !session.IsNew {
+		t.Error("session older than MaxAge was loaded")
+	}
+	if backend.has(saved.ID) {
+		t.Error("session older than MaxAge was not deleted")
+	}
+}
+
+func TestServerStoreTTLEndsAtMaxAge(t *testing.T) {
+	st, _ := newTestServerStore()
+	t0 := time.Now()
+	rec := sessionRecord{CreatedAt: t0.Add(-st.MaxAge + 10*time.Minute)}
+	if got := st.ttl(rec, t0); got != 10*time.Minute {
+		t.Errorf("ttl = %v, want 10m", got)
+	}
+	rec.CreatedAt = t0
+	if got := st.ttl(rec, t0); got != st.IdleTimeout {
+		t.Errorf("ttl = %v, want %v", got, st.IdleTimeout)
+	}
+}
+
+func TestServerStoreRenew(t *testing.T) {
+	st, backend := newTestServerStore()
+	session, _ := loggedInSession(t, st)
+	oldID := session.ID
+
+	if err := st.Renew(session); err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+	if backend.has(oldID) {
+		t.Error("old session id is still stored")
+	}
+	r := saveSession(t, st, session)
+	if session.ID == "" || session.ID == oldID {
+		t.Fatalf("session id = %q after Renew, want a new one", session.ID)
+	}
+
+	loaded, err := st.New(r, "isucon5q-go.session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if loaded.IsNew || loaded.Values["user_id"] != 42 {
+		t.Errorf("renewed session lost its values: %v", loaded.Values)
+	}
+}
+
+func TestServerStoreDeleteUser(t *testing.T) {
+	st, backend := newTestServerStore()
+	first, _ := loggedInSession(t, st)
+	second, _ := loggedInSession(t, st)
+
+	if err := backend.DeleteUser(42); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if backend.has(first.ID) || backend.has(second.ID) {
+		t.Error("sessions of the user were not deleted")
+	}
+}
+
+func TestStartSessionSweep(t *testing.T) {
+	st, backend := newTestServerStore()
+	saved, _ := loggedInSession(t, st)
+	backend.mu.Lock()
+	backend.expires[saved.ID] = time.Now().Add(-time.Second)
+	backend.mu.Unlock()
+
+	startSessionSweep(st, time.Millisecond)
+	select {
+	case <-backend.swept:
+	case <-time.After(time.Second):
+		t.Fatal("DeleteExpired was not called")
+	}
+	if backend.has(saved.ID) {
+		t.Error("expired session was not swept")
+	}
+}
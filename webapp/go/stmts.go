@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+// hotQueries are prepared once at startup instead of sending their SQL text
+// on every call. They are referred to by name.
+var hotQueries = map[string]string{
+	"user":            `SELECT ` + qualify("u", userColumns) + `, s.salt FROM users u JOIN salts s ON s.user_id = u.id WHERE u.id = ?`,
+	"update_passhash": `UPDATE users SET passhash = ? WHERE id = ?`,
+
+	"profile": `SELECT ` + profileColumns + ` FROM profiles WHERE user_id = ?`,
+	"update_profile": `UPDATE profiles
+SET first_name=?, last_name=?, sex=?, birthday=?, pref=?, updated_at=CURRENT_TIMESTAMP()
+WHERE user_id = ?`,
+
+	"entry":                       `SELECT ` + entryColumns + ` FROM entries WHERE id = ?`,
+	"entries_by_user":             `SELECT ` + entryColumns + ` FROM entries WHERE user_id = ? ORDER BY created_at LIMIT ?`,
+	"entries_by_user_desc":        `SELECT ` + entryColumns + ` FROM entries WHERE user_id = ? ORDER BY created_at DESC LIMIT ?`,
+	"public_entries_by_user":      `SELECT ` + entryColumns + ` FROM entries WHERE user_id = ? AND private=0 ORDER BY created_at LIMIT ?`,
+	"public_entries_by_user_desc": `SELECT ` + entryColumns + ` FROM entries WHERE user_id = ? AND private=0 ORDER BY created_at DESC LIMIT ?`,
+	"create_entry":                `INSERT INTO entries (user_id, private, body, title) VALUES (?,?,?,?)`,
+	"update_entry":                `UPDATE entries SET private=?, title=?, body=?, updated_at=CURRENT_TIMESTAMP() WHERE id = ?`,
+
+	"comments_by_entry": `SELECT ` + commentColumns + ` FROM comments WHERE entry_id = ?`,
+	"comments_for_owner": `SELECT ` + qualify("c", commentColumns) + ` FROM comments c JOIN entries e ON e.id = c.entry_id
+WHERE e.user_id = ?
+ORDER BY c.created_at DESC, c.id DESC
+LIMIT ? OFFSET ?`,
+	"create_comment": `INSERT INTO comments (entry_id, user_id, comment) VALUES (?,?,?)`,
+
+	"add_friend": `INSERT INTO relations (one, another) VALUES (?,?), (?,?)`,
+
+	"add_footprint": `INSERT INTO footprints (user_id,owner_id,created_at) VALUES (?,?,?)`,
+	"footprints": `SELECT ` + footprintColumns + `
+FROM footprints
+WHERE user_id = ?
+GROUP BY user_id, owner_id, DATE(created_at)
+ORDER BY updated DESC
+LIMIT ?`,
+}
+
+// statementStats exposes "<name>.calls" and "<name>.nanos" for every
+// prepared statement on /debug/vars.
+var statementStats = expvar.NewMap("sql_statements")
+
+type preparedStmt struct {
+	name  string
+	query string
+
+	mu   sync.Mutex
+	stmt *sql.Stmt
+}
+
+// stmtRegistry holds the prepared hot queries. A statement that fails to
+// prepare is prepared again on its next use. Once prepared, a statement is
+// never closed, as other requests may be using it.
+type stmtRegistry struct {
+	db    *sql.DB
+	stmts map[string]*preparedStmt
+}
+
+func newStmtRegistry(db *sql.DB, queries map[string]string) *stmtRegistry {
+	r := &stmtRegistry{db: db, stmts: make(map[string]*preparedStmt, len(queries))}
+	for name, query := range queries {
+		r.stmts[name] = &preparedStmt{name: name, query: query}
+	}
+	return r
+}
+
+// PrepareAll prepares every statement up front. Failures are only logged,
+// since the statement will be prepared again when it is used.
+func (r *stmtRegistry) PrepareAll() {
+	for _, ps := range r.stmts {
+		if _, err := r.prepare(ps); err != nil {
+			log.Printf("Failed to prepare statement %s: %s", ps.name, err.Error())
+		}
+	}
+}
+
+func (r *stmtRegistry) lookup(name string) *preparedStmt {
+	ps, ok := r.stmts[name]
+	if !ok {
+		panic("unknown statement: " + name)
+	}
+	return ps
+}
+
+func (r *stmtRegistry) prepare(ps *preparedStmt) (*sql.Stmt, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.stmt != nil {
+		return ps.stmt, nil
+	}
+	stmt, err := r.db.Prepare(ps.query)
+	if err != nil {
+		return nil, err
+	}
+	ps.stmt = stmt
+	return stmt, nil
+}
+
+// observe records a call. Lost connections need nothing here: database/sql
+// prepares a *sql.Stmt again on whichever connection runs it.
+func (r *stmtRegistry) observe(ps *preparedStmt, start time.Time) {
+	statementStats.Add(ps.name+".calls", 1)
+	statementStats.Add(ps.name+".nanos", int64(time.Since(start)))
+}
+
+func (r *stmtRegistry) Query(name string, args ...interface{}) (*sql.Rows, error) {
+	ps := r.lookup(name)
+	start := time.Now()
+	stmt, err := r.prepare(ps)
+	if err != nil {
+		r.observe(ps, start)
+		return nil, err
+	}
+	rows, err := stmt.Query(args...)
+	r.observe(ps, start)
+	return rows, err
+}
+
+// QueryRow falls back to an unprepared query when the statement can't be
+// prepared, because *sql.Row can only report errors from Scan.
+func (r *stmtRegistry) QueryRow(name string, args ...interface{}) *sql.Row {
+	ps := r.lookup(name)
+	start := time.Now()
+	stmt, err := r.prepare(ps)
+	if err != nil {
+		r.observe(ps, start)
+		return r.db.QueryRow(ps.query, args...)
+	}
+	row := stmt.QueryRow(args...)
+	r.observe(ps, start)
+	return row
+}
+
+func (r *stmtRegistry) Exec(name string, args ...interface{}) (sql.Result, error) {
+	ps := r.lookup(name)
+	start := time.Now()
+	stmt, err := r.prepare(ps)
+	if err != nil {
+		r.observe(ps, start)
+		return nil, err
+	}
+	res, err := stmt.Exec(args...)
+	r.observe(ps, start)
+	return res, err
+}
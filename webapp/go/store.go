@@ -0,0 +1,75 @@
+package main
+
+import "time"
+
+// Store is the persistence layer used by the handlers.
+// mysqlStore talks to the real database and memoryStore keeps everything
+// in process so handlers can be exercised without a MySQL server.
+type Store interface {
+	// Reset drops the rows added by the benchmark after the initial dump.
+	Reset() error
+
+	Users() ([]User, error)
+	// User returns a single user with its salt, or ErrContentNotFound.
+	User(id int) (User, string, error)
+	UpdatePassHash(userID int, hash string) error
+	// CreateUser inserts the user, its salt and an empty profile at once
+	// and returns the new id.
+	CreateUser(u User, salt string) (int, error)
+	UpdateNickName(userID int, nickName string) error
+	// UpdateEmail fails with ErrConflict, or a duplicate entry error from
+	// MySQL, when another user has the email.
+	UpdateEmail(userID int, email string) error
+	Salts() (map[int]string, error)
+
+	Profile(userID int) (Profile, error)
+	UpdateProfile(p Profile) error
+
+	Entry(id int) (Entry, error)
+	EntriesByIDs(ids []int) (map[int]Entry, error)
+	// EntriesByUser returns up to limit entries of userID ordered by created_at.
+	// Private entries are skipped unless withPrivate is set.
+	EntriesByUser(userID int, withPrivate, newestFirst bool, limit int) ([]Entry, error)
+	// RecentEntriesByUser returns the newest limit entries of every user,
+	// newest first. Only ID, UserID and CreatedAt are filled in.
+	RecentEntriesByUser(limit int) (map[int][]Entry, error)
+	CreateEntry(userID int, private bool, title, content string) (int, error)
+	// UpdateEntry saves the title, content and private flag of e and
+	// stamps its updated_at.
+	UpdateEntry(e Entry) error
+	// DeleteEntry removes the entry together with its comments.
+	DeleteEntry(id int) error
+
+	CommentsByEntry(entryID int) ([]Comment, error)
+	// CommentsForOwner returns comments on any entry of ownerID, newest first.
+	CommentsForOwner(ownerID int, limit, offset int) ([]Comment, error)
+	// CommentsOfFriends returns comments written by friendIDs, newest first,
+	// skipping private entries unless viewerID is their owner or a friend of it.
+	CommentsOfFriends(viewerID int, friendIDs []int, limit, offset int) ([]FeedComment, error)
+	// CountCommentsByEntries maps each entry id to its number of comments.
+	CountCommentsByEntries(entryIDs []int) (map[int]int, error)
+	CreateComment(entryID, userID int, comment string) (int, error)
+
+	Relations() ([]Relation, error)
+	// AddFriend stores the relation in both directions.
+	AddFriend(one, another int) error
+
+	// AddFootprint stores a visit at createdAt, the time also cached in Redis.
+	AddFootprint(userID, ownerID int, createdAt time.Time) error
+	// Footprints returns the visits to userID grouped by visitor and day,
+	// most recent first.
+	Footprints(userID, limit int) ([]Footprint, error)
+	AllFootprints() ([]Footprint, error)
+	// PruneFootprints applies PruneUserFootprints to every user.
+	PruneFootprints(keepPerUser int, before time.Time) (int64, error)
+	// PruneUserFootprints keeps the newest keepPerUser groups of Footprints
+	// and drops the groups whose latest visit is before the given time.
+	// Groups tied with the last one kept are kept too. A zero keepPerUser
+	// or before disables that rule. It returns the number of rows removed.
+	PruneUserFootprints(userID, keepPerUser int, before time.Time) (int64, error)
+}
+
+// now returns the current time with the precision of a MySQL timestamp column.
+func now() time.Time {
+	return time.Now().Truncate(time.Second)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type memoryStore struct {
+	mu sync.RWMutex
+
+	users      map[int]User
+	salts      map[int]string
+	profiles   map[int]Profile
+	entries    []Entry
+	comments   []Comment
+	relations  []Relation
+	footprints []Footprint
+}
+
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:    map[int]User{},
+		salts:    map[int]string{},
+		profiles: map[int]Profile{},
+	}
+}
+
+// AddUser seeds a user together with its salt and an empty profile.
+func (s *memoryStore) AddUser(u User, salt string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.ID] = u
+	s.salts[u.ID] = salt
+	s.profiles[u.ID] = Profile{UserID: u.ID, UpdatedAt: now()}
+}
+
+func (s *memoryStore) Reset() error {
+	return nil
+}
+
+func (s *memoryStore) Users() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func (s *memoryStore) User(id int) (User, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[id]
+	if !ok {
+		return User{}, "", ErrContentNotFound
+	}
+	return u, s.salts[id], nil
+}
+
+func (s *memoryStore) UpdatePassHash(userID int, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[userID]; ok {
+		u.PassHash = hash
+		s.users[userID] = u
+	}
+	return nil
+}
+
+func (s *memoryStore) CreateUser(u User, salt string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, other := range s.users {
+		if other.AccountName == u.AccountName || other.Email == u.Email {
+			return 0, ErrConflict
+		}
+		if other.ID >= u.ID {
+			u.ID = other.ID + 1
+		}
+	}
+	if u.ID == 0 {
+		u.ID = 1
+	}
+	s.users[u.ID] = u
+	s.salts[u.ID] = salt
+	s.profiles[u.ID] = Profile{UserID: u.ID, UpdatedAt: now()}
+	return u.ID, nil
+}
+
+func (s *memoryStore) UpdateNickName(userID int, nickName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrContentNotFound
+	}
+	u.NickName = nickName
+	s.users[userID] = u
+	return nil
+}
+
+func (s *memoryStore) UpdateEmail(userID int, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrContentNotFound
+	}
+	for _, other := range s.users {
+		if other.ID != userID && other.Email == email {
+			return ErrConflict
+		}
+	}
+	u.Email = email
+	s.users[userID] = u
+	return nil
+}
+
+func (s *memoryStore) Salts() (map[int]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	salts := make(map[int]string, len(s.salts))
+	for id, salt := range s.salts {
+		salts[id] = salt
+	}
+	return salts, nil
+}
+
+func (s *memoryStore) Profile(userID int) (Profile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.profiles[userID], nil
+}
+
+func (s *memoryStore) UpdateProfile(p Profile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.profiles[p.UserID]; !ok {
+		return nil
+	}
+	p.UpdatedAt = now()
+	s.profiles[p.UserID] = p
+	return nil
+}
+
+func (s *memoryStore) Entry(id int) (Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, e := range s.entries {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+	return Entry{}, ErrContentNotFound
+}
+
+func (s *memoryStore) EntriesByIDs(ids []int) (map[int]Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	wanted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	entries := make(map[int]Entry, len(ids))
+	for _, e := range s.entries {
+		if wanted[e.ID] {
+			entries[e.ID] = e
+		}
+	}
+	return entries, nil
+}
+
+// entries are appended in id order, which is also created_at order.
+func (s *memoryStore) EntriesByUser(userID int, withPrivate, newestFirst bool, limit int) ([]Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := make([]Entry, 0, limit)
+	for i := range s.entries {
+		e := s.entries[i]
+		if newestFirst {
+			e = s.entries[len(s.entries)-1-i]
+		}
+		if e.UserID != userID || (e.Private && !withPrivate) {
+			continue
+		}
+		entries = append(entries, e)
+		if len(entries) >= limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func (s *memoryStore) RecentEntriesByUser(limit int) (map[int][]Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	recent := map[int][]Entry{}
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		e := s.entries[i]
+		if len(recent[e.UserID]) < limit {
+			recent[e.UserID] = append(recent[e.UserID], e)
+		}
+	}
+	return recent, nil
+}
+
+func (s *memoryStore) CreateEntry(userID int, private bool, title, content string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := 1
+	if n := len(s.entries); n > 0 {
+		id = s.entries[n-1].ID + 1
+	}
+	s.entries = append(s.entries, Entry{ID: id, UserID: userID, Private: private, Title: title, Content: content, CreatedAt: now()})
+	return id, nil
+}
+
+func (s *memoryStore) UpdateEntry(e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.entries {
+		if s.entries[i].ID == e.ID {
+			s.entries[i].Private = e.Private
+			s.entries[i].Title = e.Title
+			s.entries[i].Content = e.Content
+			s.entries[i].UpdatedAt = mysql.NullTime{Time: now(), Valid: true}
+			return nil
+		}
+	}
+	return ErrContentNotFound
+}
+
+func (s *memoryStore) DeleteEntry(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := false
+	entries := s.entries[:0]
+	for _, e := range s.entries {
+		if e.ID == id {
+			found = true
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if !found {
+		return ErrContentNotFound
+	}
+	s.entries = entries
+	comments := s.comments[:0]
+	for _, c := range s.comments {
+		if c.EntryID != id {
+			comments = append(comments, c)
+		}
+	}
+	s.comments = comments
+	return nil
+}
+
+func (s *memoryStore) CommentsByEntry(entryID int) ([]Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	comments := []Comment{}
+	for _, c := range s.comments {
+		if c.EntryID == entryID {
+			comments = append(comments, c)
+		}
+	}
+	return comments, nil
+}
+
+func (s *memoryStore) CommentsForOwner(ownerID int, limit, offset int) ([]Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	owned := map[int]bool{}
+	for _, e := range s.entries {
+		if e.UserID == ownerID {
+			owned[e.ID] = true
+		}
+	}
+	comments := make([]Comment, 0, limit)
+	for i := len(s.comments) - 1; i >= 0 && len(comments) < limit; i-- {
+		c := s.comments[i]
+		if !owned[c.EntryID] {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		comments = append(comments, c)
+	}
+	return comments, nil
+}
+
+func (s *memoryStore) CommentsOfFriends(viewerID int, friendIDs []int, limit, offset int) ([]FeedComment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	isFriend := make(map[int]bool, len(friendIDs))
+	for _, id := range friendIDs {
+		isFriend[id] = true
+	}
+	owners := make(map[int]Entry, len(s.entries))
+	for _, e := range s.entries {
+		owners[e.ID] = e
+	}
+	comments := make([]FeedComment, 0, limit)
+	for i := len(s.comments) - 1; i >= 0 && len(comments) < limit; i-- {
+		c := s.comments[i]
+		entry, ok := owners[c.EntryID]
+		if !ok || !isFriend[c.UserID] {
+			continue
+		}
+		if entry.Private && entry.UserID != viewerID && !isFriend[entry.UserID] {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		comments = append(comments, FeedComment{c, entry.UserID})
+	}
+	return comments, nil
+}
+
+func (s *memoryStore) CountCommentsByEntries(entryIDs []int) (map[int]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := make(map[int]int, len(entryIDs))
+	for _, id := range entryIDs {
+		counts[id] = 0
+	}
+	for _, c := range s.comments {
+		if n, ok := counts[c.EntryID]; ok {
+			counts[c.EntryID] = n + 1
+		}
+	}
+	return counts, nil
+}
+
+func (s *memoryStore) CreateComment(entryID, userID int, comment string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := 1
+	if n := len(s.comments); n > 0 {
+		id = s.comments[n-1].ID + 1
+	}
+	s.comments = append(s.comments, Comment{id, entryID, userID, comment, now()})
+	return id, nil
+}
+
+func (s *memoryStore) Relations() ([]Relation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Relation(nil), s.relations...), nil
+}
+
+func (s *memoryStore) AddFriend(one, another int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := now()
+	s.relations = append(s.relations, Relation{one, another, t}, Relation{another, one, t})
+	return nil
+}
+
+func (s *memoryStore) AddFootprint(userID, ownerID int, createdAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.footprints = append(s.footprints, Footprint{userID, ownerID, createdAt, createdAt})
+	return nil
+}
+
+func (s *memoryStore) Footprints(userID, limit int) ([]Footprint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	type key struct {
+		ownerID int
+		date    time.Time
+	}
+	latest := map[key]time.Time{}
+	for _, fp := range s.footprints {
+		if fp.UserID != userID {
+			continue
+		}
+		y, m, d := fp.CreatedAt.In(footprintLocation).Date()
+		k := key{fp.OwnerID, time.Date(y, m, d, 0, 0, 0, 0, footprintLocation)}
+		if fp.CreatedAt.After(latest[k]) {
+			latest[k] = fp.CreatedAt
+		}
+	}
+
+	footprints := make([]Footprint, 0, len(latest))
+	for k, updated := range latest {
+		footprints = append(footprints, Footprint{userID, k.ownerID, k.date, updated})
+	}
+	sort.Slice(footprints, func(i, j int) bool {
+		return footprints[i].UpdatedAt.After(footprints[j].UpdatedAt)
+	})
+	if len(footprints) > limit {
+		footprints = footprints[:limit]
+	}
+	return footprints, nil
+}
+
+func (s *memoryStore) AllFootprints() ([]Footprint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Footprint(nil), s.footprints...), nil
+}
+
+func (s *memoryStore) PruneFootprints(keepPerUser int, before time.Time) (int64, error) {
+	s.mu.RLock()
+	userIDs := map[int]bool{}
+	for _, fp := range s.footprints {
+		userIDs[fp.UserID] = true
+	}
+	s.mu.RUnlock()
+
+	var pruned int64
+	for userID := range userIDs {
+		n, _ := s.PruneUserFootprints(userID, keepPerUser, before)
+		pruned += n
+	}
+	return pruned, nil
+}
+
+// PruneUserFootprints works like the MySQL version: rows older than the
+// latest visit of the last group kept are dropped.
+func (s *memoryStore) PruneUserFootprints(userID, keepPerUser int, before time.Time) (int64, error) {
+	cutoff := before
+	if keepPerUser > 0 {
+		groups, _ := s.Footprints(userID, keepPerUser)
+		if len(groups) == keepPerUser && groups[keepPerUser-1].UpdatedAt.After(cutoff) {
+			cutoff = groups[keepPerUser-1].UpdatedAt
+		}
+	}
+	if cutoff.IsZero() {
+		return 0, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	footprints := make([]Footprint, 0, len(s.footprints))
+	for _, fp := range s.footprints {
+		if fp.UserID != userID || !fp.CreatedAt.Before(cutoff) {
+			footprints = append(footprints, fp)
+		}
+	}
+	pruned := int64(len(s.footprints) - len(footprints))
+	s.footprints = footprints
+	return pruned, nil
+}
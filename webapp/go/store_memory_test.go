@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPruneFootprintsCountsGroups(t *testing.T) {
+	ms := NewMemoryStore()
+	day := time.Date(2026, 1, 10, 12, 0, 0, 0, footprintLocation)
+	// Five visits by 2 on one day make a single group.
+	for i := 0; i < 5; i++ {
+		visit := day.Add(time.Duration(i) * time.Minute)
+		ms.footprints = append(ms.footprints, Footprint{1, 2, visit, visit})
+	}
+	// One visit by 3 on each of the four days before.
+	for d := 1; d <= 4; d++ {
+		visit := day.AddDate(0, 0, -d)
+		ms.footprints = append(ms.footprints, Footprint{1, 3, visit, visit})
+	}
+
+	before, _ := ms.Footprints(1, 10)
+	n, err := ms.PruneFootprints(3, time.Time{})
+	if err != nil {
+		t.Fatalf("PruneFootprints: %v", err)
+	}
+	after, _ := ms.Footprints(1, 10)
+	if n != 2 || len(after) != 3 {
+		t.Fatalf("pruned %d rows leaving %d groups, want 2 and 3", n, len(after))
+	}
+	for i := range after {
+		if after[i] != before[i] {
+			t.Errorf("group %d = %+v, want %+v", i, after[i], before[i])
+		}
+	}
+}
+
+func TestPruneUserFootprintsByAge(t *testing.T) {
+	ms := NewMemoryStore()
+	t0 := time.Date(2026, 1, 10, 12, 0, 0, 0, footprintLocation)
+	for _, visit := range []time.Time{t0.AddDate(0, 0, -10), t0.Add(-time.Hour), t0} {
+		ms.footprints = append(ms.footprints, Footprint{1, 2, visit, visit})
+		ms.footprints = append(ms.footprints, Footprint{4, 2, visit, visit})
+	}
+
+	if n, _ := ms.PruneUserFootprints(1, 0, t0.AddDate(0, 0, -1)); n != 1 {
+		t.Errorf("pruned %d rows, want the one older than a day", n)
+	}
+	if fps, _ := ms.Footprints(4, 10); len(fps) != 2 {
+		t.Errorf("footprints of another user were pruned: %v", fps)
+	}
+}
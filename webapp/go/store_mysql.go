@@ -0,0 +1,493 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+type mysqlStore struct {
+	db    *sql.DB
+	stmts *stmtRegistry
+}
+
+func NewMySQLStore(db *sql.DB) Store {
+	stmts := newStmtRegistry(db, hotQueries)
+	stmts.PrepareAll()
+	return &mysqlStore{db: db, stmts: stmts}
+}
+
+// inClause returns the placeholders and arguments for an IN (...) clause over ids.
+func inClause(ids []int) (string, []interface{}) {
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	return strings.Repeat(",?", len(ids))[1:], args
+}
+
+func (s *mysqlStore) Reset() error {
+	for _, q := range []string{
+		"DELETE FROM relations WHERE id > 500000",
+		"DELETE FROM footprints WHERE id > 500000",
+		"DELETE FROM entries WHERE id > 500000",
+		"DELETE FROM comments WHERE id > 1500000",
+	} {
+		if _, err := s.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mysqlStore) Users() ([]User, error) {
+	rows, err := s.db.Query(`SELECT ` + userColumns + ` FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *mysqlStore) User(id int) (User, string, error) {
+	var salt string
+	u, err := scanUser(s.stmts.QueryRow("user", id), &salt)
+	if err == sql.ErrNoRows {
+		return User{}, "", ErrContentNotFound
+	}
+	return u, salt, err
+}
+
+func (s *mysqlStore) UpdatePassHash(userID int, hash string) error {
+	_, err := s.stmts.Exec("update_passhash", hash, userID)
+	return err
+}
+
+func (s *mysqlStore) CreateUser(u User, salt string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO users (account_name, nick_name, email, passhash) VALUES (?,?,?,?)`,
+		u.AccountName, u.NickName, u.Email, u.PassHash)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO salts (user_id, salt) VALUES (?,?)`, id, salt); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO profiles (user_id, first_name, last_name, sex, birthday, pref) VALUES (?,'','','',NULL,'')`, id); err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+func (s *mysqlStore) UpdateNickName(userID int, nickName string) error {
+	_, err := s.db.Exec(`UPDATE users SET nick_name = ? WHERE id = ?`, nickName, userID)
+	return err
+}
+
+func (s *mysqlStore) UpdateEmail(userID int, email string) error {
+	_, err := s.db.Exec(`UPDATE users SET email = ? WHERE id = ?`, email, userID)
+	return err
+}
+
+func (s *mysqlStore) Salts() (map[int]string, error) {
+	rows, err := s.db.Query(`SELECT user_id, salt FROM salts`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	salts := map[int]string{}
+	for rows.Next() {
+		var id int
+		var salt string
+		if err := rows.Scan(&id, &salt); err != nil {
+			return nil, err
+		}
+		salts[id] = salt
+	}
+	return salts, rows.Err()
+}
+
+func (s *mysqlStore) Profile(userID int) (Profile, error) {
+	prof, err := scanProfile(s.stmts.QueryRow("profile", userID))
+	if err == sql.ErrNoRows {
+		return Profile{}, nil
+	}
+	return prof, err
+}
+
+func (s *mysqlStore) UpdateProfile(p Profile) error {
+	_, err := s.stmts.Exec("update_profile", p.FirstName, p.LastName, p.Sex, p.Birthday, p.Pref, p.UserID)
+	return err
+}
+
+func scanEntries(rows *sql.Rows) ([]Entry, error) {
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *mysqlStore) Entry(id int) (Entry, error) {
+	e, err := scanEntry(s.stmts.QueryRow("entry", id))
+	if err == sql.ErrNoRows {
+		return Entry{}, ErrContentNotFound
+	}
+	return e, err
+}
+
+func (s *mysqlStore) EntriesByIDs(ids []int) (map[int]Entry, error) {
+	entries := make(map[int]Entry, len(ids))
+	if len(ids) == 0 {
+		return entries, nil
+	}
+	holders, args := inClause(ids)
+	rows, err := s.db.Query(`SELECT `+entryColumns+` FROM entries WHERE id IN (`+holders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	list, err := scanEntries(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range list {
+		entries[e.ID] = e
+	}
+	return entries, nil
+}
+
+func (s *mysqlStore) EntriesByUser(userID int, withPrivate, newestFirst bool, limit int) ([]Entry, error) {
+	name := "entries_by_user"
+	if !withPrivate {
+		name = "public_" + name
+	}
+	if newestFirst {
+		name += "_desc"
+	}
+	rows, err := s.stmts.Query(name, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanEntries(rows)
+}
+
+func (s *mysqlStore) RecentEntriesByUser(limit int) (map[int][]Entry, error) {
+	rows, err := s.db.Query(`SELECT id, user_id, created_at FROM entries ORDER BY created_at DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recent := map[int][]Entry{}
+	for rows.Next() {
+		e := Entry{}
+		if err := rows.Scan(&e.ID, &e.UserID, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if len(recent[e.UserID]) < limit {
+			recent[e.UserID] = append(recent[e.UserID], e)
+		}
+	}
+	return recent, rows.Err()
+}
+
+func (s *mysqlStore) CreateEntry(userID int, private bool, title, content string) (int, error) {
+	p := 0
+	if private {
+		p = 1
+	}
+	res, err := s.stmts.Exec("create_entry", userID, p, content, title)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (s *mysqlStore) UpdateEntry(e Entry) error {
+	p := 0
+	if e.Private {
+		p = 1
+	}
+	res, err := s.stmts.Exec("update_entry", p, e.Title, e.Content, e.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := s.Entry(e.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mysqlStore) DeleteEntry(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM comments WHERE entry_id = ?`, id); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM entries WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrContentNotFound
+	}
+	return tx.Commit()
+}
+
+func scanComments(rows *sql.Rows) ([]Comment, error) {
+	defer rows.Close()
+
+	comments := []Comment{}
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+func (s *mysqlStore) CommentsByEntry(entryID int) ([]Comment, error) {
+	rows, err := s.stmts.Query("comments_by_entry", entryID)
+	if err != nil {
+		return nil, err
+	}
+	return scanComments(rows)
+}
+
+func (s *mysqlStore) CommentsForOwner(ownerID int, limit, offset int) ([]Comment, error) {
+	rows, err := s.stmts.Query("comments_for_owner", ownerID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanComments(rows)
+}
+
+func (s *mysqlStore) CommentsOfFriends(viewerID int, friendIDs []int, limit, offset int) ([]FeedComment, error) {
+	if len(friendIDs) == 0 {
+		return []FeedComment{}, nil
+	}
+	holders, args := inClause(friendIDs)
+	query := `SELECT ` + qualify("c", commentColumns) + `, e.user_id
+FROM comments c JOIN entries e ON e.id = c.entry_id
+WHERE c.user_id IN (` + holders + `)
+  AND (e.private = 0 OR e.user_id = ? OR e.user_id IN (` + holders + `))
+ORDER BY c.created_at DESC, c.id DESC
+LIMIT ? OFFSET ?`
+	params := make([]interface{}, 0, 2*len(args)+3)
+	params = append(params, args...)
+	params = append(params, viewerID)
+	params = append(params, args...)
+	params = append(params, limit, offset)
+	rows, err := s.db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []FeedComment{}
+	for rows.Next() {
+		var entryOwnerID int
+		c, err := scanComment(rows, &entryOwnerID)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, FeedComment{c, entryOwnerID})
+	}
+	return comments, rows.Err()
+}
+
+func (s *mysqlStore) CountCommentsByEntries(entryIDs []int) (map[int]int, error) {
+	counts := make(map[int]int, len(entryIDs))
+	if len(entryIDs) == 0 {
+		return counts, nil
+	}
+	holders, args := inClause(entryIDs)
+	rows, err := s.db.Query(`SELECT entry_id, COUNT(*) AS c FROM comments WHERE entry_id IN (`+holders+`) GROUP BY entry_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entryID, n int
+		if err := rows.Scan(&entryID, &n); err != nil {
+			return nil, err
+		}
+		counts[entryID] = n
+	}
+	return counts, rows.Err()
+}
+
+func (s *mysqlStore) CreateComment(entryID, userID int, comment string) (int, error) {
+	res, err := s.stmts.Exec("create_comment", entryID, userID, comment)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (s *mysqlStore) Relations() ([]Relation, error) {
+	rows, err := s.db.Query(`SELECT one, another, created_at FROM relations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rels := []Relation{}
+	for rows.Next() {
+		rel := Relation{}
+		if err := rows.Scan(&rel.One, &rel.Another, &rel.CreatedAt); err != nil {
+			return nil, err
+		}
+		rels = append(rels, rel)
+	}
+	return rels, rows.Err()
+}
+
+func (s *mysqlStore) AddFriend(one, another int) error {
+	_, err := s.stmts.Exec("add_friend", one, another, another, one)
+	return err
+}
+
+func (s *mysqlStore) AddFootprint(userID, ownerID int, createdAt time.Time) error {
+	_, err := s.stmts.Exec("add_footprint", userID, ownerID, createdAt)
+	return err
+}
+
+func (s *mysqlStore) Footprints(userID, limit int) ([]Footprint, error) {
+	rows, err := s.stmts.Query("footprints", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	footprints := []Footprint{}
+	for rows.Next() {
+		fp, err := scanFootprint(rows)
+		if err != nil {
+			return nil, err
+		}
+		footprints = append(footprints, fp)
+	}
+	return footprints, rows.Err()
+}
+
+func (s *mysqlStore) AllFootprints() ([]Footprint, error) {
+	rows, err := s.db.Query(`SELECT user_id, owner_id, created_at, created_at AS updated FROM footprints`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	footprints := []Footprint{}
+	for rows.Next() {
+		fp, err := scanFootprint(rows)
+		if err != nil {
+			return nil, err
+		}
+		footprints = append(footprints, fp)
+	}
+	return footprints, rows.Err()
+}
+
+func (s *mysqlStore) PruneFootprints(keepPerUser int, before time.Time) (int64, error) {
+	var pruned int64
+	if !before.IsZero() {
+		res, err := s.db.Exec(`DELETE FROM footprints WHERE created_at < ?`, before)
+		if err != nil {
+			return pruned, err
+		}
+		n, _ := res.RowsAffected()
+		pruned += n
+	}
+	if keepPerUser <= 0 {
+		return pruned, nil
+	}
+
+	rows, err := s.db.Query(`SELECT user_id FROM footprints GROUP BY user_id HAVING COUNT(DISTINCT owner_id, DATE(created_at)) > ?`, keepPerUser)
+	if err != nil {
+		return pruned, err
+	}
+	userIDs := []int{}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return pruned, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+
+	for _, userID := range userIDs {
+		n, err := s.PruneUserFootprints(userID, keepPerUser, time.Time{})
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// PruneUserFootprints deletes the rows older than the latest visit of the
+// last group kept. The other rows of a kept group may go too, but its
+// latest visit stays, so the grouped view of Footprints is unchanged.
+func (s *mysqlStore) PruneUserFootprints(userID, keepPerUser int, before time.Time) (int64, error) {
+	cutoff := before
+	if keepPerUser > 0 {
+		var lastKept time.Time
+		err := s.db.QueryRow(`SELECT MAX(created_at) AS updated FROM footprints WHERE user_id = ?
+GROUP BY owner_id, DATE(created_at)
+ORDER BY updated DESC
+LIMIT 1 OFFSET ?`, userID, keepPerUser-1).Scan(&lastKept)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		if err == nil && lastKept.After(cutoff) {
+			cutoff = lastKept
+		}
+	}
+	if cutoff.IsZero() {
+		return 0, nil
+	}
+	res, err := s.db.Exec(`DELETE FROM footprints WHERE user_id = ? AND created_at < ?`, userID, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	templates map[string]*template.Template
+	// reloadTemplates makes render parse the template files on every call,
+	// so templates can be edited without restarting the app.
+	reloadTemplates = os.Getenv("ISUCON5_TEMPLATE_RELOAD") == "1"
+)
+
+var templatePages = []string{
+	"login.html",
+	"login_locked.html",
+	"error.html",
+	"index.html",
+	"profile.html",
+	"entries.html",
+	"entry.html",
+	"footprints.html",
+	"friends.html",
+	"signup.html",
+	"account.html",
+}
+
+// templateFuncs must not depend on the request: anything about the current
+// user is passed to the template through its data.
+var templateFuncs = template.FuncMap{
+	"getUser": func(id int) (*User, error) {
+		return getUser(nil, id)
+	},
+	"prefectures": func() []string {
+		return prefs
+	},
+	"substring": func(s string, l int) string {
+		if len(s) > l {
+			return s[:l]
+		}
+		return s
+	},
+	"split": strings.Split,
+}
+
+func getTemplatePath(file string) string {
+	return path.Join("templates", file)
+}
+
+func parseTemplate(file string) (*template.Template, error) {
+	return template.New(file).Funcs(templateFuncs).ParseFiles(getTemplatePath(file), getTemplatePath("header.html"))
+}
+
+func loadTemplates() {
+	tpls := make(map[string]*template.Template, len(templatePages))
+	for _, file := range templatePages {
+		tpls[file] = template.Must(parseTemplate(file))
+	}
+	templates = tpls
+}
+
+func render(w http.ResponseWriter, status int, file string, data interface{}) error {
+	tpl := templates[file]
+	if reloadTemplates {
+		var err error
+		if tpl, err = parseTemplate(file); err != nil {
+			return err
+		}
+	}
+	if tpl == nil {
+		return fmt.Errorf("unknown template %s", file)
+	}
+	// Execute into a buffer so that a failing template function still
+	// leaves the response untouched for the error page.
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return err
+	}
+	w.WriteHeader(status)
+	_, err := buf.WriteTo(w)
+	return err
+}
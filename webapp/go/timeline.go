@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// timelineSize is the number of friends' entries shown on the index page.
+const timelineSize = 10
+
+type timelineItem struct {
+	EntryID   int
+	CreatedAt time.Time
+}
+
+// entryTimeline keeps, for every user, the newest entries written by their
+// friends. It is built in /initialize and updated on write: a new entry is
+// pushed to the feed of every friend of its author, and a new friendship
+// merges each side's latest entries into the other's feed.
+type entryTimeline struct {
+	mu sync.RWMutex
+	// authored holds the newest entries of each user.
+	authored map[int][]timelineItem
+	// feeds holds the newest entries of each user's friends.
+	feeds map[int][]timelineItem
+}
+
+var timeline = newEntryTimeline()
+
+func newEntryTimeline() *entryTimeline {
+	return &entryTimeline{
+		authored: map[int][]timelineItem{},
+		feeds:    map[int][]timelineItem{},
+	}
+}
+
+func newerItem(a, b timelineItem) bool {
+	if a.CreatedAt.Equal(b.CreatedAt) {
+		return a.EntryID > b.EntryID
+	}
+	return a.CreatedAt.After(b.CreatedAt)
+}
+
+// mergeItems merges lists sorted newest first and keeps the first timelineSize.
+func mergeItems(lists ...[]timelineItem) []timelineItem {
+	merged := []timelineItem{}
+	for _, list := range lists {
+		merged = append(merged, list...)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return newerItem(merged[i], merged[j])
+	})
+	if len(merged) > timelineSize {
+		merged = merged[:timelineSize]
+	}
+	return merged
+}
+
+// Load rebuilds every feed from the newest entries of each author and the
+// current friendship graph.
+func (t *entryTimeline) Load(recent map[int][]Entry, graph *friendGraph) {
+	authored := make(map[int][]timelineItem, len(recent))
+	for userID, entries := range recent {
+		items := make([]timelineItem, 0, len(entries))
+		for _, e := range entries {
+			items = append(items, timelineItem{e.ID, e.CreatedAt})
+		}
+		authored[userID] = mergeItems(items)
+	}
+
+	adjacency := graph.Adjacency()
+	feeds := make(map[int][]timelineItem, len(adjacency))
+	for userID, friendIDs := range adjacency {
+		lists := make([][]timelineItem, 0, len(friendIDs))
+		for _, friendID := range friendIDs {
+			lists = append(lists, authored[friendID])
+		}
+		feeds[userID] = mergeItems(lists...)
+	}
+
+	t.mu.Lock()
+	t.authored = authored
+	t.feeds = feeds
+	t.mu.Unlock()
+}
+
+// AddEntry fans a new entry out to the feeds of the author's friends.
+func (t *entryTimeline) AddEntry(e Entry, friends []Friend) {
+	item := timelineItem{e.ID, e.CreatedAt}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.authored[e.UserID] = mergeItems([]timelineItem{item}, t.authored[e.UserID])
+	for _, f := range friends {
+		t.feeds[f.ID] = mergeItems([]timelineItem{item}, t.feeds[f.ID])
+	}
+}
+
+// RemoveEntry drops a deleted entry of author. recent are the author's
+// newest entries after the deletion, which refill the author's list; the
+// feeds of the author's friends are then rebuilt from their friends' lists.
+func (t *entryTimeline) RemoveEntry(author, entryID int, recent []Entry, graph *friendGraph) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Entries added since recent was read are still in authored.
+	seen := map[int]bool{entryID: true}
+	items := []timelineItem{}
+	for _, item := range t.authored[author] {
+		if !seen[item.EntryID] {
+			seen[item.EntryID] = true
+			items = append(items, item)
+		}
+	}
+	for _, e := range recent {
+		if !seen[e.ID] {
+			seen[e.ID] = true
+			items = append(items, timelineItem{e.ID, e.CreatedAt})
+		}
+	}
+	t.authored[author] = mergeItems(items)
+
+	for _, f := range graph.FriendsOf(author) {
+		friendsOfF := graph.FriendsOf(f.ID)
+		lists := make([][]timelineItem, 0, len(friendsOfF))
+		for _, ff := range friendsOfF {
+			lists = append(lists, t.authored[ff.ID])
+		}
+		t.feeds[f.ID] = mergeItems(lists...)
+	}
+}
+
+// AddFriend merges the latest entries of one and another into each other's feed.
+func (t *entryTimeline) AddFriend(one, another int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.feeds[one] = mergeItems(t.feeds[one], t.authored[another])
+	t.feeds[another] = mergeItems(t.feeds[another], t.authored[one])
+}
+
+// Feed returns the ids of the newest entries of userID's friends, newest first.
+func (t *entryTimeline) Feed(userID int) []int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ids := make([]int, 0, len(t.feeds[userID]))
+	for _, item := range t.feeds[userID] {
+		ids = append(ids, item.EntryID)
+	}
+	return ids
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var timelineEpoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// entriesOf returns entries ids[0..] of userID, the first one newest.
+func entriesOf(userID int, ids ...int) []Entry {
+	entries := make([]Entry, 0, len(ids))
+	for _, id := range ids {
+		entries = append(entries, Entry{ID: id, UserID: userID, CreatedAt: timelineEpoch.Add(time.Duration(id) * time.Minute)})
+	}
+	return entries
+}
+
+func TestTimelineLoad(t *testing.T) {
+	graph := newFriendGraph()
+	graph.Add(1, 2, timelineEpoch)
+	graph.Add(1, 3, timelineEpoch)
+	tl := newEntryTimeline()
+	tl.Load(map[int][]Entry{2: entriesOf(2, 5, 1), 3: entriesOf(3, 4, 2)}, graph)
+
+	if got, want := tl.Feed(1), []int{5, 4, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Feed(1) = %v, want %v", got, want)
+	}
+	if got := tl.Feed(4); len(got) != 0 {
+		t.Errorf("Feed of a user without friends = %v", got)
+	}
+}
+
+func TestTimelineAddEntryKeepsNewest(t *testing.T) {
+	graph := newFriendGraph()
+	graph.Add(1, 2, timelineEpoch)
+	tl := newEntryTimeline()
+	tl.Load(map[int][]Entry{}, graph)
+
+	for id := 1; id <= timelineSize+2; id++ {
+		tl.AddEntry(entriesOf(2, id)[0], graph.FriendsOf(2))
+	}
+	feed := tl.Feed(1)
+	if len(feed) != timelineSize || feed[0] != timelineSize+2 || feed[timelineSize-1] != 3 {
+		t.Errorf("Feed(1) = %v, want the newest %d entries", feed, timelineSize)
+	}
+	if got := tl.Feed(2); len(got) != 0 {
+		t.Errorf("author's own feed = %v, want empty", got)
+	}
+}
+
+func TestTimelineAddEntryOrdersByCreatedAt(t *testing.T) {
+	graph := newFriendGraph()
+	graph.Add(1, 2, timelineEpoch)
+	tl := newEntryTimeline()
+	tl.Load(map[int][]Entry{}, graph)
+
+	tl.AddEntry(Entry{ID: 7, UserID: 2, CreatedAt: timelineEpoch.Add(time.Hour)}, graph.FriendsOf(2))
+	tl.AddEntry(Entry{ID: 8, UserID: 2, CreatedAt: timelineEpoch}, graph.FriendsOf(2))
+	// Same time: the higher id is newer.
+	tl.AddEntry(Entry{ID: 9, UserID: 2, CreatedAt: timelineEpoch.Add(time.Hour)}, graph.FriendsOf(2))
+
+	if got, want := tl.Feed(1), []int{9, 7, 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Feed(1) = %v, want %v", got, want)
+	}
+}
+
+func TestTimelineAddFriend(t *testing.T) {
+	graph := newFriendGraph()
+	tl := newEntryTimeline()
+	tl.Load(map[int][]Entry{1: entriesOf(1, 3), 2: entriesOf(2, 2, 1)}, graph)
+
+	graph.Add(1, 2, timelineEpoch)
+	tl.AddFriend(1, 2)
+	if got, want := tl.Feed(1), []int{2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Feed(1) = %v, want %v", got, want)
+	}
+	if got, want := tl.Feed(2), []int{3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Feed(2) = %v, want %v", got, want)
+	}
+}
+
+func TestTimelineRemoveEntry(t *testing.T) {
+	graph := newFriendGraph()
+	graph.Add(1, 2, timelineEpoch)
+	graph.Add(1, 3, timelineEpoch)
+	tl := newEntryTimeline()
+
+	// Author 2 has more entries than the timeline holds; 3 has one.
+	ids := []int{}
+	for id := timelineSize + 1; id >= 1; id-- {
+		ids = append(ids, id)
+	}
+	all := entriesOf(2, ids...)
+	tl.Load(map[int][]Entry{2: all[:timelineSize], 3: entriesOf(3, 100)}, graph)
+
+	// Deleting the newest entry of 2 brings back its oldest one.
+	tl.RemoveEntry(2, timelineSize+1, all[1:], graph)
+	feed := tl.Feed(1)
+	if len(feed) != timelineSize || feed[0] != 100 {
+		t.Fatalf("Feed(1) = %v", feed)
+	}
+	for _, id := range feed {
+		if id == timelineSize+1 {
+			t.Errorf("deleted entry is still in Feed(1) = %v", feed)
+		}
+	}
+	if got, want := feed[timelineSize-1], 2; got != want {
+		t.Errorf("oldest entry in Feed(1) = %d, want %d", got, want)
+	}
+}
+
+func TestTimelineRemoveEntryKeepsNewerEntries(t *testing.T) {
+	graph := newFriendGraph()
+	graph.Add(1, 2, timelineEpoch)
+	tl := newEntryTimeline()
+	tl.Load(map[int][]Entry{2: entriesOf(2, 2, 1)}, graph)
+	// Added after recent below was read.
+	tl.AddEntry(entriesOf(2, 3)[0], graph.FriendsOf(2))
+
+	tl.RemoveEntry(2, 1, entriesOf(2, 2), graph)
+	if got, want := tl.Feed(1), []int{3, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Feed(1) = %v, want %v", got, want)
+	}
+}
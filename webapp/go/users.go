@@ -0,0 +1,145 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+)
+
+var (
+	// usersLoadedLazily counts users that were missing from the directory
+	// but found in the store, i.e. created since the last /initialize.
+	usersLoadedLazily = expvar.NewInt("users_loaded_lazily")
+	usersNotFound     = expvar.NewInt("users_not_found")
+)
+
+// userDirectory holds every user and salt in memory.
+// It is read by every request and reloaded by /initialize, so all access
+// goes through the mutex. byEmail and byAccount index byID so that login
+// and profile lookups don't scan every user.
+type userDirectory struct {
+	mu        sync.RWMutex
+	byID      map[int]User
+	byEmail   map[string]int
+	byAccount map[string]int
+	salts     map[int]string
+}
+
+func newUserDirectory() *userDirectory {
+	return &userDirectory{
+		byID:      map[int]User{},
+		byEmail:   map[string]int{},
+		byAccount: map[string]int{},
+		salts:     map[int]string{},
+	}
+}
+
+// Load replaces the whole directory.
+func (d *userDirectory) Load(users []User, salts map[int]string) {
+	byID := make(map[int]User, len(users))
+	byEmail := make(map[string]int, len(users))
+	byAccount := make(map[string]int, len(users))
+	for _, u := range users {
+		byID[u.ID] = u
+		byEmail[u.Email] = u.ID
+		byAccount[u.AccountName] = u.ID
+	}
+
+	d.mu.Lock()
+	d.byID = byID
+	d.byEmail = byEmail
+	d.byAccount = byAccount
+	d.salts = salts
+	d.mu.Unlock()
+}
+
+// Add registers or replaces a single user without reloading the others.
+func (d *userDirectory) Add(u User, salt string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.byID[u.ID]; ok {
+		delete(d.byEmail, old.Email)
+		delete(d.byAccount, old.AccountName)
+	}
+	d.byID[u.ID] = u
+	d.byEmail[u.Email] = u.ID
+	d.byAccount[u.AccountName] = u.ID
+	d.salts[u.ID] = salt
+}
+
+// Update changes one user in place through fn, so that concurrent updates
+// of other fields are not overwritten with an older copy.
+func (d *userDirectory) Update(id int, fn func(u *User)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u, ok := d.byID[id]
+	if !ok {
+		return
+	}
+	delete(d.byEmail, u.Email)
+	delete(d.byAccount, u.AccountName)
+	fn(&u)
+	d.byID[id] = u
+	d.byEmail[u.Email] = id
+	d.byAccount[u.AccountName] = id
+}
+
+func (d *userDirectory) ByID(id int) (User, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	u, ok := d.byID[id]
+	return u, ok
+}
+
+func (d *userDirectory) ByEmail(email string) (User, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	id, ok := d.byEmail[email]
+	if !ok {
+		return User{}, false
+	}
+	return d.byID[id], true
+}
+
+func (d *userDirectory) ByAccountName(name string) (User, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	id, ok := d.byAccount[name]
+	if !ok {
+		return User{}, false
+	}
+	return d.byID[id], true
+}
+
+// lookupUser returns the user from the directory, loading it from the store
+// when it is not known yet. A user that doesn't exist is ErrContentNotFound.
+func lookupUser(id int) (User, error) {
+	if u, ok := users.ByID(id); ok {
+		return u, nil
+	}
+	u, salt, err := storage.User(id)
+	if err != nil {
+		if err == ErrContentNotFound {
+			usersNotFound.Add(1)
+		}
+		return User{}, err
+	}
+	users.Add(u, salt)
+	usersLoadedLazily.Add(1)
+	return u, nil
+}
+
+// Each calls fn for every user while holding the read lock.
+func (d *userDirectory) Each(fn func(User)) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, u := range d.byID {
+		fn(u)
+	}
+}
+
+func (d *userDirectory) Salt(id int) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	s, ok := d.salts[id]
+	return s, ok
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// fieldErrors maps a form field name to the message shown next to it.
+// A form is valid when it has no errors.
+type fieldErrors map[string]string
+
+// fieldRule checks a single form value and returns an error message,
+// or "" when the value is acceptable.
+type fieldRule func(value string) string
+
+// formRules lists the rules of each field, checked in order until one fails.
+type formRules map[string][]fieldRule
+
+func (rules formRules) validate(r *http.Request) fieldErrors {
+	errs := fieldErrors{}
+	for field, checks := range rules {
+		value := r.FormValue(field)
+		for _, check := range checks {
+			if msg := check(value); msg != "" {
+				errs[field] = msg
+				break
+			}
+		}
+	}
+	return errs
+}
+
+func required(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "入力してください"
+	}
+	return ""
+}
+
+// maxChars matches a varchar(n) column, which counts characters.
+func maxChars(n int) fieldRule {
+	return func(value string) string {
+		if utf8.RuneCountInString(value) > n {
+			return fmt.Sprintf("%d文字以内で入力してください", n)
+		}
+		return ""
+	}
+}
+
+func minChars(n int) fieldRule {
+	return func(value string) string {
+		if utf8.RuneCountInString(value) < n {
+			return fmt.Sprintf("%d文字以上で入力してください", n)
+		}
+		return ""
+	}
+}
+
+func matches(re *regexp.Regexp, msg string) fieldRule {
+	return func(value string) string {
+		if !re.MatchString(value) {
+			return msg
+		}
+		return ""
+	}
+}
+
+func emailAddress(value string) string {
+	if a, err := mail.ParseAddress(value); err != nil || a.Address != value {
+		return "メールアドレスの形式が正しくありません"
+	}
+	return ""
+}
+
+// maxBytes matches a text column, which counts bytes.
+func maxBytes(n int) fieldRule {
+	return func(value string) string {
+		if len(value) > n {
+			return "長すぎます"
+		}
+		return ""
+	}
+}
+
+// dateFormat accepts an empty value, which leaves the date unset. Users
+// created by signup have no birthday, so profiles.birthday is nullable.
+func dateFormat(layout string) fieldRule {
+	return func(value string) string {
+		if value == "" {
+			return ""
+		}
+		if _, err := time.Parse(layout, value); err != nil {
+			return "日付の形式が正しくありません"
+		}
+		return ""
+	}
+}
+
+func oneOf(choices []string) fieldRule {
+	return func(value string) string {
+		for _, c := range choices {
+			if value == c {
+				return ""
+			}
+		}
+		return "選択肢から選んでください"
+	}
+}
+
+// The limits follow the column sizes in schema.sql and alterdb.sql.
+const maxTextBytes = 65535
+
+var (
+	profileRules = formRules{
+		"first_name": {maxChars(64)},
+		"last_name":  {maxChars(64)},
+		"sex":        {oneOf(sexes)},
+		"birthday":   {dateFormat("2006-01-02")},
+		"pref":       {oneOf(prefs)},
+	}
+	entryRules = formRules{
+		"title":   {maxChars(191)},
+		"content": {maxBytes(maxTextBytes)},
+	}
+	commentRules = formRules{
+		"comment": {required, maxBytes(maxTextBytes)},
+	}
+
+	// Account names are part of URLs such as /profile/{account_name}.
+	accountNamePattern = regexp.MustCompile(`^[0-9A-Za-z_]+$`)
+	nickNameRule       = []fieldRule{required, maxChars(32)}
+	emailRule          = []fieldRule{required, maxChars(255), emailAddress}
+	passwordRule       = []fieldRule{minChars(8), maxBytes(72)}
+
+	signupRules = formRules{
+		"account_name": {required, maxChars(64), matches(accountNamePattern, "半角英数字と_で入力してください")},
+		"nick_name":    nickNameRule,
+		"email":        emailRule,
+		"password":     passwordRule,
+	}
+	emailChangeRules = formRules{
+		"email":          emailRule,
+		"email_password": {required},
+	}
+	passwordChangeRules = formRules{
+		"current_password": {required},
+		"new_password":     passwordRule,
+	}
+	nickNameChangeRules = formRules{
+		"nick_name": nickNameRule,
+	}
+)
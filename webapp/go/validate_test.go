@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func validateForm(rules formRules, form url.Values) fieldErrors {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return rules.validate(r)
+}
+
+func TestFieldRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  fieldRule
+		value string
+		ok    bool
+	}{
+		{"required", required, "x", true},
+		{"required blank", required, " \t", false},
+		{"maxChars counts runes", maxChars(3), "あいう", true},
+		{"maxChars", maxChars(3), "あいうえ", false},
+		{"minChars", minChars(2), "a", false},
+		{"maxBytes counts bytes", maxBytes(3), "あ", true},
+		{"maxBytes", maxBytes(3), "あa", false},
+		{"dateFormat", dateFormat("2006-01-02"), "1990-04-01", true},
+		{"dateFormat invalid", dateFormat("2006-01-02"), "1990-02-30", false},
+		{"dateFormat empty", dateFormat("2006-01-02"), "", true},
+		{"oneOf", oneOf(sexes), "その他", true},
+		{"oneOf unknown", oneOf(sexes), "秘密", false},
+		{"emailAddress", emailAddress, "a@example.com", true},
+		{"emailAddress with name", emailAddress, "A <a@example.com>", false},
+		{"matches", matches(accountNamePattern, "bad"), "bad name", false},
+	}
+	for _, tt := range tests {
+		if msg := tt.rule(tt.value); (msg == "") != tt.ok {
+			t.Errorf("%s(%q) = %q, want ok=%v", tt.name, tt.value, msg, tt.ok)
+		}
+	}
+}
+
+func TestProfileRules(t *testing.T) {
+	valid := url.Values{"first_name": {"あり"}, "last_name": {"す"}, "sex": {"未指定"}, "birthday": {"1990-04-01"}, "pref": {"未入力"}}
+	if errs := validateForm(profileRules, valid); len(errs) != 0 {
+		t.Errorf("valid profile: %v", errs)
+	}
+
+	errs := validateForm(profileRules, url.Values{"first_name": {strings.Repeat("あ", 65)}, "sex": {"x"}, "birthday": {"1990/04/01"}, "pref": {"東京"}})
+	for _, field := range []string{"first_name", "sex", "birthday", "pref"} {
+		if errs[field] == "" {
+			t.Errorf("no error for %s: %v", field, errs)
+		}
+	}
+	if _, ok := errs["last_name"]; ok {
+		t.Errorf("empty last_name was rejected: %v", errs)
+	}
+}
+
+func TestFormRulesStopAtFirstError(t *testing.T) {
+	errs := validateForm(commentRules, url.Values{"comment": {""}})
+	if errs["comment"] != "入力してください" {
+		t.Errorf("comment error = %q, want the required message", errs["comment"])
+	}
+}
+
+func TestSignupRules(t *testing.T) {
+	valid := url.Values{"account_name": {"carol_1"}, "nick_name": {"Carol"}, "email": {"carol@example.com"}, "password": {"password1"}}
+	if errs := validateForm(signupRules, valid); len(errs) != 0 {
+		t.Errorf("valid signup: %v", errs)
+	}
+	errs := validateForm(signupRules, url.Values{"account_name": {"carol/1"}, "email": {"carol"}, "password": {"short"}})
+	if len(errs) != 4 {
+		t.Errorf("got errors %v, want one for each field", errs)
+	}
+}
@@ -1,2 +1,14 @@
 alter table entries add title varchar(191) not null default '';
 UPDATE entries SET title=SUBSTRING_INDEX(body, '\n', 1);
+alter table comments add index user_id (user_id, created_at);
+alter table profiles modify birthday date null;
+CREATE TABLE IF NOT EXISTS sessions (
+  `id` varchar(64) NOT NULL PRIMARY KEY,
+  `user_id` int NOT NULL DEFAULT 0,
+  `data` blob NOT NULL,
+  `expires_at` datetime NOT NULL,
+  KEY `user_id` (`user_id`),
+  KEY `expires_at` (`expires_at`)
+) DEFAULT CHARSET=utf8;
+alter table entries add updated_at timestamp null default null;
+alter table footprints add index user_id (user_id, created_at), add index created_at (created_at);